@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var ConfigFile string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&ConfigFile, "config", "", "JSON file providing defaults for flags, keyed by flag name")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return loadConfig(cmd, ConfigFile)
+	}
+}
+
+// Applies the values of a JSON config file to the flags not explicitly set
+// on the command line, i.e.
+//
+//	{ "page-size": 50, "columns": ["from", "subject", "header:X-Mailer"] }
+func loadConfig(cmd *cobra.Command, filename string) error {
+	if filename == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+	flags := cmd.Flags()
+	for name, value := range config {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			if !definesFlag(cmd.Root(), name) {
+				return fmt.Errorf("invalid config file %s: unknown flag '%s'", filename, name)
+			}
+			// meant for another command
+			continue
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := setFlag(flags, flag, value); err != nil {
+			return fmt.Errorf("invalid config file %s: flag '%s': %v", filename, name, err)
+		}
+	}
+	return nil
+}
+
+// Tells whether a command or any of its subcommands defines a flag.
+func definesFlag(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+	for _, sub := range cmd.Commands() {
+		if definesFlag(sub, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFlag(flags *pflag.FlagSet, flag *pflag.Flag, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, configValue(item))
+		}
+		return flags.Set(flag.Name, strings.Join(items, ","))
+	case map[string]interface{}:
+		// map flags, i.e. { "extract-text-max-size": { "pdf": "10MB" } }
+		if !strings.HasPrefix(flag.Value.Type(), "stringTo") {
+			return fmt.Errorf("objects are only supported by key=value flags")
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, 0, len(v))
+		for _, key := range keys {
+			items = append(items, key+"="+configValue(v[key]))
+		}
+		return flags.Set(flag.Name, strings.Join(items, ","))
+	default:
+		return flags.Set(flag.Name, configValue(v))
+	}
+}
+
+func configValue(value interface{}) string {
+	if v, ok := value.(float64); ok {
+		// avoid exponent notation for big numbers
+		return strings.TrimSuffix(fmt.Sprintf("%f", v), ".000000")
+	}
+	return fmt.Sprint(value)
+}
@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/davidecavestro/gmail-exporter/logger"
@@ -10,6 +16,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb/v7"
+	"github.com/xuri/excelize/v2"
 	"go.uber.org/ratelimit"
 	"google.golang.org/api/gmail/v1"
 )
@@ -24,16 +31,67 @@ var NoProgressBar bool
 var NoAttachments bool
 var AttachmentsDir string
 var AttachmentsSeed *[]int32
+var AttachmentsCollision string
+var AttachmentsStore string
+var AttachmentsLink string
+var AttachmentsReuseBySize bool
+var AttachmentsIncludeTypes []string
+var AttachmentsExcludeTypes []string
+var AttachmentsIncludeExts []string
+var AttachmentsExcludeExts []string
+var AttachmentsIncludePattern string
+var AttachmentsExcludePattern string
+var AttachmentsMinSize string
+var AttachmentsMaxSize string
+var AttachmentsInline bool
+var AttachmentsPath string
+var EmlPath string
+var Integrity bool
+var FetchPlan string
+var EmlCompress string
+var EmlCompressLevel int
+var ExtractText []string
+var ExtractTextMaxSize map[string]string
+var ExtractTextTimeout time.Duration
+var ExtractTextExcerpt int
+var HtmlPagesDir string
+var HtmlPagesEmbed bool
 var SaveEml bool
 var EmlDir string
 var EmlSeed *[]int32
+var EmlFormat string
 var NoHtmlBody bool
 var NoTextBody bool
+var Columns []string
+var Timezone string
+var HtmlDir string
+var ParquetFile string
+var ParquetRowGroup int
+var TemplateFile string
+var TemplateHeader string
+var TemplateFooter string
+var TemplateOut string
+var TemplateHtml bool
+var Bundle string
+var CellOverflow string
+var CellSplitColumns int
+var SidecarDir string
+var Rollover string
+var MaxRows int
+var SheetPerLabel bool
+var LabelDedup string
+var ThreadView bool
+var AddressesSheet bool
+var Analytics bool
+var Append bool
+var FetchThreads bool
 
 func init() {
 	exportCmd.Flags().Int64VarP(&PageLimit, "pages-limit", "l", 0, "Max message pages fetched (default 0, so unlimited)")
 	exportCmd.Flags().Int64VarP(&PageSize, "page-size", "p", 25, "Messages per page")
 	exportCmd.Flags().StringVarP(&OutputFile, "out-file", "f", "messages.xlsx", "Output file")
+	exportCmd.Flags().BoolVar(&Append, "append", false, "Add new messages to the existing output file, refreshing labels and state of the present ones")
+	exportCmd.Flags().StringVar(&Bundle, "bundle", "", "Write all the outputs into a single .zip or .tar.gz archive")
 
 	exportCmd.Flags().IntVarP(&MessagesPerSec, "messages-per-sec", "m", 0, "Limit download of messages per second (default 0, so unlimited)")
 	exportCmd.Flags().IntVarP(&AttachmentsPerSec, "attachments-per-sec", "c", 0, "Limit download of attachments per second (default 0, so unlimited)")
@@ -46,15 +104,64 @@ func init() {
 	exportCmd.Flags().StringVarP(&AttachmentsDir, "attachments-dir", "d", "attachments", "Attachments output directory")
 	AttachmentsSeed = &[]int32{}
 	exportCmd.Flags().Int32SliceVarP(AttachmentsSeed, "attachments-seed", "x", defaultAttachmentsSeed, "Attachments subfolder naming strategy")
+	exportCmd.Flags().StringVar(&AttachmentsPath, "attachments-path", "", "Template of the attachments subfolder of every message, replacing the seed, i.e. {{.Year}}/{{.Month}}/{{.ID}}")
+	exportCmd.Flags().StringVar(&AttachmentsStore, "attachments-store", "", "Save attachments once by content (SHA-256) into this directory")
+	exportCmd.Flags().StringVar(&AttachmentsLink, "attachments-link", svc.StoreLinkNone, "Reference stored attachments from the message folders through 'hardlink' or 'symlink', or 'none'")
+	exportCmd.Flags().BoolVar(&AttachmentsReuseBySize, "attachments-reuse-by-size", false, "Reuse downloads of stored attachments with the same name, type and size")
+	exportCmd.Flags().StringSliceVar(&AttachmentsIncludeTypes, "attachments-include-type", nil, "Save only attachments of these MIME types, i.e. image/*")
+	exportCmd.Flags().StringSliceVar(&AttachmentsExcludeTypes, "attachments-exclude-type", nil, "Don't save attachments of these MIME types, i.e. video/*")
+	exportCmd.Flags().StringSliceVar(&AttachmentsIncludeExts, "attachments-include-ext", nil, "Save only attachments with these extensions, i.e. pdf,docx")
+	exportCmd.Flags().StringSliceVar(&AttachmentsExcludeExts, "attachments-exclude-ext", nil, "Don't save attachments with these extensions, i.e. exe,ics")
+	exportCmd.Flags().StringVar(&AttachmentsIncludePattern, "attachments-include-pattern", "", "Save only attachments whose name matches this regular expression")
+	exportCmd.Flags().StringVar(&AttachmentsExcludePattern, "attachments-exclude-pattern", "", "Don't save attachments whose name matches this regular expression")
+	exportCmd.Flags().StringVar(&AttachmentsMinSize, "attachments-min-size", "", "Don't save attachments smaller than this size, i.e. 10KB")
+	exportCmd.Flags().StringVar(&AttachmentsMaxSize, "attachments-max-size", "", "Don't save attachments bigger than this size, i.e. 20MB")
+	exportCmd.Flags().BoolVar(&AttachmentsInline, "attachments-inline", false, "Also save the parts embedded in the message body, i.e. inline images")
+	exportCmd.Flags().StringSliceVar(&ExtractText, "extract-text", nil, fmt.Sprintf("Extract the text of attachments of these types, or 'all': %s", strings.Join(svc.ExtractTextTypes, ", ")))
+	exportCmd.Flags().StringToStringVar(&ExtractTextMaxSize, "extract-text-max-size", nil, fmt.Sprintf("Size limits of the attachments to extract text from, by type, i.e. pdf=50MB,xlsx=5MB (default %s, 0 for none)", svc.HumanBytes(svc.DefaultExtractMaxSize)))
+	exportCmd.Flags().DurationVar(&ExtractTextTimeout, "extract-text-timeout", 30*time.Second, "Time limit for the text extraction of every attachment")
+	exportCmd.Flags().IntVar(&ExtractTextExcerpt, "extract-text-excerpt", 1000, "Length of the extracted text reported by the attachment_text column")
+	exportCmd.Flags().StringVar(&AttachmentsCollision, "attachments-collision", svc.CollisionCounter, "Naming of attachments clashing with saved ones: 'counter', 'part-id' or content 'hash'")
 
 	exportCmd.Flags().BoolVarP(&SaveEml, "save-eml", "e", false, "Export every message on a separated EML file")
 	defaultEmlSeed := []int32{2, 2}
 	exportCmd.Flags().StringVarP(&EmlDir, "eml-dir", "r", "messages", "EML output directory")
 	EmlSeed = &[]int32{}
 	exportCmd.Flags().Int32SliceVarP(EmlSeed, "eml-seed", "z", defaultEmlSeed, "EML subfolder naming strategy")
+	exportCmd.Flags().StringVar(&EmlPath, "eml-path", "", "Template of the EML file path of every message, without extension, replacing the seed, i.e. {{.Year}}/{{.Month}}/{{.ID}}-{{.Subject | slug}}")
+	exportCmd.Flags().StringVar(&EmlCompress, "eml-compress", svc.EmlCompressNone, "Compress EML files: 'gzip' (.eml.gz), 'zstd' (.eml.zst) or 'none'")
+	exportCmd.Flags().IntVar(&EmlCompressLevel, "eml-compress-level", 0, "EML compression level: 1-9 for gzip, 1-22 for zstd (default 0, so the format default)")
+	exportCmd.Flags().StringVar(&EmlFormat, "eml-format", "eml", "EML output layout: 'eml' for seed based subfolders, 'maildir' for a Maildir++ tree")
 
 	exportCmd.Flags().BoolVarP(&NoHtmlBody, "no-html-body", "j", false, "Omit html body on the spreadsheet")
 	exportCmd.Flags().BoolVarP(&NoTextBody, "no-text-body", "k", false, "Omit text body on the spreadsheet")
+	exportCmd.Flags().StringVar(&Timezone, "timezone", "Local", "Timezone of spreadsheet dates, as IANA name (i.e. Europe/Rome)")
+	exportCmd.Flags().StringSliceVar(&Columns, "columns", svc.DefaultColumns, "Spreadsheet columns: built-in names or header:<name> for any header")
+	exportCmd.Flags().StringVar(&CellOverflow, "cell-overflow", svc.CellOverflowTruncate, "Policy for bodies exceeding the cell limit: 'truncate', 'split' on continuation columns or 'sidecar' files")
+	exportCmd.Flags().IntVar(&CellSplitColumns, "cell-split-columns", 4, "Continuation columns added to bodies by the split policy")
+	exportCmd.Flags().StringVar(&SidecarDir, "sidecar-dir", "bodies", "Output directory of the sidecar policy")
+	exportCmd.Flags().StringVar(&Rollover, "rollover", svc.RolloverSheet, "When a sheet reaches the row limit continue on a new 'sheet' or on a new 'file'")
+	exportCmd.Flags().IntVar(&MaxRows, "max-rows", 0, "Rows per sheet, header included (default 0, so the Excel limit)")
+	exportCmd.Flags().BoolVar(&SheetPerLabel, "sheet-per-label", false, "Export messages carrying any of the labels, on a sheet per label after a summary sheet")
+	exportCmd.Flags().BoolVar(&AddressesSheet, "addresses-sheet", false, "Also write an Addresses sheet, with a row for every address of every message")
+	exportCmd.Flags().BoolVar(&Analytics, "analytics", false, "Also write analytics sheets with charts: top senders, volume over time, attachment stats...")
+	exportCmd.Flags().BoolVar(&ThreadView, "thread-view", false, "Also write messages grouped by thread, on a Threads sheet")
+	exportCmd.Flags().BoolVar(&FetchThreads, "fetch-threads", false, "Export whole threads, even messages not carrying the labels")
+	exportCmd.Flags().StringVar(&LabelDedup, "label-dedup", svc.LabelDedupAll, "Sheets of messages carrying several labels: 'all' of them or just the 'first' one")
+
+	exportCmd.Flags().StringVar(&HtmlDir, "html-dir", "", "Also write a browsable html archive into this directory")
+	exportCmd.Flags().StringVar(&FetchPlan, "fetch-plan", svc.FetchFull, "How messages are fetched: 'full' structured messages, or 'raw' sources parsed locally, fetching every message once")
+	exportCmd.Flags().BoolVar(&Integrity, "integrity", false, "Also write a manifest with the SHA-256 of every exported file next to the output file, checked by the verify command")
+	exportCmd.Flags().StringVar(&HtmlPagesDir, "html-pages-dir", "", "Also write the html body of every message as a self-contained page into this directory, along with inline images")
+	exportCmd.Flags().BoolVar(&HtmlPagesEmbed, "html-pages-embed", false, "Embed inline images within the html pages as data URIs, rather than linking the saved files")
+	exportCmd.Flags().StringVar(&ParquetFile, "parquet-file", "", "Also write messages into this parquet file")
+	exportCmd.Flags().IntVar(&ParquetRowGroup, "parquet-row-group", 1000, "Messages per parquet row group")
+
+	exportCmd.Flags().StringVar(&TemplateFile, "template", "", "Also render every message through this go template")
+	exportCmd.Flags().StringVar(&TemplateHeader, "template-header", "", "Template rendered before messages")
+	exportCmd.Flags().StringVar(&TemplateFooter, "template-footer", "", "Template rendered after messages")
+	exportCmd.Flags().StringVar(&TemplateOut, "template-out", "report.txt", "Output file for the rendered templates")
+	exportCmd.Flags().BoolVar(&TemplateHtml, "template-html", false, "Use html/template, escaping contents for html")
 
 	rootCmd.AddCommand(exportCmd)
 }
@@ -78,7 +185,11 @@ var exportCmd = &cobra.Command{
 		messagesLimit := MessagesPerSec
 		attachmentsLimit := AttachmentsPerSec
 
-		// messageLimiter := ratelimit.New(messagesLimit, limitWindow)
+		// shared by message and thread fetches
+		var messageLimiter ratelimit.Limiter
+		if messagesLimit != 0 {
+			messageLimiter = ratelimit.New(messagesLimit, limitWindow)
+		}
 
 		// initialize progress container, with custom width
 		pui := ui.ProgressUI{Hide: NoProgressBar || BatchMode, BarContainer: mpb.New(mpb.WithWidth(ProgressBarWidth))}
@@ -88,22 +199,192 @@ var exportCmd = &cobra.Command{
 		outputFile := OutputFile
 		labels := args
 
-		msgs, totalMessages := svc.GetMessages(srv, messagesLimit, &pui, user, pageSize, pageLimit, labels...)
+		columnSpec := make([]string, 0, len(Columns))
+		for _, column := range Columns {
+			if (NoTextBody && column == "text_body") || (NoHtmlBody && column == "html_body") {
+				continue
+			}
+			columnSpec = append(columnSpec, column)
+		}
+		columns, err := svc.ParseColumns(columnSpec)
+		if err != nil {
+			logger.Fatalf("Invalid columns: %v", err)
+		}
+
+		switch CellOverflow {
+		case svc.CellOverflowTruncate, svc.CellOverflowSplit, svc.CellOverflowSidecar:
+		default:
+			logger.Fatalf("Unsupported cell overflow policy: %s", CellOverflow)
+		}
+		switch LabelDedup {
+		case svc.LabelDedupAll, svc.LabelDedupFirst:
+		default:
+			logger.Fatalf("Unsupported label dedup policy: %s", LabelDedup)
+		}
+		switch FetchPlan {
+		case svc.FetchFull, svc.FetchRaw:
+		default:
+			logger.Fatalf("Unsupported fetch plan: %s", FetchPlan)
+		}
+		switch Rollover {
+		case svc.RolloverSheet, svc.RolloverFile:
+		default:
+			logger.Fatalf("Unsupported rollover policy: %s", Rollover)
+		}
+		if MaxRows < 0 || MaxRows == 1 {
+			// the header row takes one
+			logger.Fatalf("Unsupported max rows: %d, use 0 for the Excel limit or at least 2", MaxRows)
+		}
+
+		var appendTo *excelize.File
+		if Append {
+			// outputs rewritten as a whole, that would just hold the new messages
+			conflicts := make([]string, 0)
+			for flag, set := range map[string]bool{
+				"--bundle":          Bundle != "",
+				"--sheet-per-label": SheetPerLabel,
+				"--thread-view":     ThreadView,
+				"--analytics":       Analytics,
+				"--addresses-sheet": AddressesSheet,
+				"--html-dir":        HtmlDir != "",
+				"--parquet-file":    ParquetFile != "",
+				"--template":        TemplateFile != "",
+				"--rollover file":   Rollover == svc.RolloverFile,
+			} {
+				if set {
+					conflicts = append(conflicts, flag)
+				}
+			}
+			if len(conflicts) > 0 {
+				sort.Strings(conflicts)
+				logger.Fatalf("--append supports just the messages sheet, not: %s", strings.Join(conflicts, ", "))
+			}
+			if _, err := os.Stat(outputFile); err == nil {
+				if appendTo, err = excelize.OpenFile(outputFile); err != nil {
+					logger.Fatalf("Unable to open xls file: %v", err)
+				}
+			} else if !os.IsNotExist(err) {
+				logger.Fatalf("Unable to open xls file: %v", err)
+			}
+			if Integrity && appendTo != nil {
+				// the manifest has to cover the previous exports too
+				if _, err := os.Stat(filepath.Join(filepath.Dir(outputFile), svc.IntegrityManifestName)); err != nil {
+					logger.Fatalf("--append --integrity needs the manifest of the previous exports: %v", err)
+				}
+			}
+		}
+
+		location, err := time.LoadLocation(Timezone)
+		if err != nil {
+			logger.Fatalf("Invalid timezone: %v", err)
+		}
+
+		var out svc.Output = &svc.DirOutput{}
+		if Bundle != "" {
+			if out, err = svc.NewBundleOutput(Bundle); err != nil {
+				logger.Fatalf("Unable to prepare bundle: %v", err)
+			}
+		}
+		var integrity *svc.Integrity
+		if Integrity {
+			if integrity, err = svc.NewIntegrity(out, filepath.Dir(outputFile), Append); err != nil {
+				logger.Fatalf("Unable to prepare integrity manifest: %v", err)
+			}
+			out = integrity
+		}
+
+		getMessages := svc.GetMessages
+		if SheetPerLabel {
+			getMessages = svc.GetAnyLabelMessages
+		}
+		msgs, totalMessages := getMessages(srv, messageLimiter, &pui, user, pageSize, pageLimit, FetchPlan, labels...)
+		if FetchThreads {
+			msgs = svc.ExpandThreads(srv, messageLimiter, &pui, user, FetchPlan, msgs)
+		}
 
 		var attachmentLimiter ratelimit.Limiter
 		if attachmentsLimit != 0 {
 			attachmentLimiter = ratelimit.New(attachmentsLimit, limitWindow)
 		}
+		var labelNames map[string]string
+		getLabelNames := func() map[string]string {
+			if labelNames == nil {
+				labelNames, err = svc.GetLabelNames(srv, user)
+				if err != nil {
+					logger.Fatalf("Unable to retrieve labels: %v", err)
+				}
+			}
+			return labelNames
+		}
+		// paths of the files of every message, named after their data
+		pathTemplate := func(flag string, text string) *svc.PathTemplate {
+			if text == "" {
+				return nil
+			}
+			tmpl, err := svc.NewPathTemplate(text, location, getLabelNames())
+			if err != nil {
+				logger.Fatalf("Invalid --%s: %v", flag, err)
+			}
+			return tmpl
+		}
+
 		var saveMsgAttachments svc.SaveMsgAttachments = nil
+		var attachmentOpts *svc.AttachmentOptions
 		if !NoAttachments {
+			switch AttachmentsCollision {
+			case svc.CollisionCounter, svc.CollisionPartId, svc.CollisionHash:
+			default:
+				logger.Fatalf("Unsupported attachments collision strategy: %s", AttachmentsCollision)
+			}
+			attachmentOpts = &svc.AttachmentOptions{
+				Dir:      AttachmentsDir,
+				Seed:     AttachmentsSeed,
+				Template: pathTemplate("attachments-path", AttachmentsPath),
+				Names:    svc.NewUniqueFilenames(AttachmentsCollision),
+				// html pages show inline images
+				Inline: AttachmentsInline || HtmlPagesDir != "",
+			}
+			if AttachmentsStore != "" {
+				switch AttachmentsLink {
+				case svc.StoreLinkNone:
+				case svc.StoreLinkHard, svc.StoreLinkSymbolic:
+					if Bundle != "" {
+						logger.Fatalf("Bundles do not support attachment links")
+					}
+				default:
+					logger.Fatalf("Unsupported attachments link: %s", AttachmentsLink)
+				}
+				attachmentOpts.Store = svc.NewContentStore(AttachmentsStore, AttachmentsLink, AttachmentsReuseBySize)
+			}
+			attachmentOpts.Filter = attachmentFilter()
+			attachmentOpts.Extractor = textExtractor()
 			saveMsgAttachments = func(msg *gmail.Message) ([]*svc.LocalAttachment, error) {
-				return svc.SaveAttachments(srv, attachmentLimiter, AttachmentsDir, AttachmentsSeed, user, msg)
+				return svc.SaveAttachments(srv, attachmentLimiter, out, attachmentOpts, user, msg)
 			}
 		}
+
 		var saveEml svc.SaveEml = nil
 		if SaveEml {
-			saveEml = func(msg *gmail.Message) (string, error) {
-				return svc.SaveMessageFile(srv, EmlDir, EmlSeed, user, msg.Id)
+			switch EmlFormat {
+			case "eml":
+				emlTemplate := pathTemplate("eml-path", EmlPath)
+				compressor, err := svc.NewEmlCompressor(EmlCompress, EmlCompressLevel)
+				if err != nil {
+					logger.Fatalf("Invalid EML compression: %v", err)
+				}
+				saveEml = func(msg *gmail.Message) (string, error) {
+					return svc.SaveMessageFile(srv, out, EmlDir, EmlSeed, emlTemplate, compressor, user, msg)
+				}
+			case "maildir":
+				if EmlPath != "" || EmlCompress != svc.EmlCompressNone {
+					logger.Fatalf("Maildir folders do not support --eml-path nor --eml-compress")
+				}
+				maildir := svc.NewMaildir(out, EmlDir, getLabelNames())
+				saveEml = func(msg *gmail.Message) (string, error) {
+					return maildir.Save(srv, user, msg)
+				}
+			default:
+				logger.Fatalf("Unsupported EML format: %s", EmlFormat)
 			}
 		}
 
@@ -113,10 +394,191 @@ var exportCmd = &cobra.Command{
 		} else {
 			messageCount = totalMessages
 		}
-		file := svc.ExportMessages(msgs, messageCount, &pui, saveMsgAttachments, saveEml, NoHtmlBody, NoTextBody)
+		sinks := make([]svc.MessageSink, 0)
+		if HtmlDir != "" {
+			archive, err := svc.NewHtmlArchive(out, HtmlDir, getLabelNames())
+			if err != nil {
+				logger.Fatalf("Unable to prepare html archive: %v", err)
+			}
+			sinks = append(sinks, archive)
+		}
+		if HtmlPagesDir != "" {
+			pages, err := svc.NewHtmlPages(out, HtmlPagesDir, HtmlPagesEmbed)
+			if err != nil {
+				logger.Fatalf("Unable to prepare html pages: %v", err)
+			}
+			sinks = append(sinks, pages)
+		}
+		if ParquetFile != "" {
+			parquetFile, err := svc.NewParquetFile(out, ParquetFile, getLabelNames(), ParquetRowGroup, NoHtmlBody, NoTextBody)
+			if err != nil {
+				logger.Fatalf("Unable to prepare parquet file: %v", err)
+			}
+			sinks = append(sinks, parquetFile)
+		}
+		if TemplateFile != "" {
+			templateOutput, err := svc.NewTemplateOutput(out, TemplateOut, TemplateFile, TemplateHeader, TemplateFooter, TemplateHtml, getLabelNames())
+			if err != nil {
+				logger.Fatalf("Unable to prepare template output: %v", err)
+			}
+			sinks = append(sinks, templateOutput)
+		}
 
-		if err := file.SaveAs(outputFile); err != nil {
-			logger.Fatalf("Unable to save xls file: %v", err)
+		if integrity != nil {
+			// closed last, once all the other sinks have written their files
+			sinks = append(sinks, integrity.Sink())
+		}
+
+		spreadsheetOpts := &svc.SpreadsheetOptions{
+			Columns:        columns,
+			Location:       location,
+			WorkbookDir:    filepath.Dir(out.Path(outputFile)),
+			CellOverflow:   CellOverflow,
+			SplitColumns:   CellSplitColumns,
+			SidecarDir:     SidecarDir,
+			Output:         out,
+			MaxRows:        MaxRows,
+			Rollover:       Rollover,
+			LabelDedup:     LabelDedup,
+			ThreadView:     ThreadView,
+			AddressesSheet: AddressesSheet,
+			Analytics:      Analytics,
+			AppendTo:       appendTo,
+			// further workbooks are named after the first one, i.e. messages-2.xlsx
+			SaveWorkbook: func(file *excelize.File, part int) error {
+				filename := outputFile
+				if part > 1 {
+					ext := filepath.Ext(outputFile)
+					filename = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(outputFile, ext), part, ext)
+				}
+				w, err := out.Create(filename)
+				if err != nil {
+					return err
+				}
+				if _, err := file.WriteTo(w); err != nil {
+					w.Close()
+					return err
+				}
+				return w.Close()
+			},
+		}
+		if SheetPerLabel {
+			if spreadsheetOpts.LabelSheets, err = svc.GetLabelsByIdOrName(srv, user, labels...); err != nil {
+				logger.Fatalf("Unable to retrieve labels: %v", err)
+			}
+		}
+		for _, column := range columns {
+			switch column.Name {
+			case "gmail_link":
+				if spreadsheetOpts.Account, err = svc.GetAccountEmail(srv, user); err != nil {
+					logger.Fatalf("Unable to retrieve account: %v", err)
+				}
+			case "labels", "user_labels":
+				spreadsheetOpts.LabelNames = getLabelNames()
+			}
+		}
+		svc.ExportMessages(msgs, messageCount, &pui, saveMsgAttachments, saveEml, spreadsheetOpts, sinks...)
+
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				logger.Fatalf("Unable to complete export: %v", err)
+			}
+		}
+		if err := out.Close(); err != nil {
+			logger.Fatalf("Unable to complete export: %v", err)
+		}
+		if attachmentOpts != nil && attachmentOpts.Store != nil {
+			logger.Info(fmt.Sprintf("Attachment store saved %s, reusing %d downloads",
+				svc.HumanBytes(attachmentOpts.Store.SavedBytes), attachmentOpts.Store.ReusedDownloads))
 		}
 	},
 }
+
+// Returns the filter of the attachments to be saved, or nil when saving all
+// of them.
+func attachmentFilter() *svc.AttachmentFilter {
+	filter := &svc.AttachmentFilter{
+		IncludeTypes: AttachmentsIncludeTypes,
+		ExcludeTypes: AttachmentsExcludeTypes,
+		IncludeExts:  AttachmentsIncludeExts,
+		ExcludeExts:  AttachmentsExcludeExts,
+	}
+	compile := func(flag string, pattern string) *regexp.Regexp {
+		if pattern == "" {
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Fatalf("Invalid --%s: %v", flag, err)
+		}
+		return re
+	}
+	filter.IncludePattern = compile("attachments-include-pattern", AttachmentsIncludePattern)
+	filter.ExcludePattern = compile("attachments-exclude-pattern", AttachmentsExcludePattern)
+	size := func(flag string, value string) int64 {
+		if value == "" {
+			return 0
+		}
+		size, err := svc.ParseBytes(value)
+		if err != nil {
+			logger.Fatalf("Invalid --%s: %v", flag, err)
+		}
+		return size
+	}
+	filter.MinSize = size("attachments-min-size", AttachmentsMinSize)
+	filter.MaxSize = size("attachments-max-size", AttachmentsMaxSize)
+	if filter.MaxSize > 0 && filter.MinSize > filter.MaxSize {
+		logger.Fatalf("--attachments-min-size exceeds --attachments-max-size")
+	}
+	if len(filter.IncludeTypes)+len(filter.ExcludeTypes)+len(filter.IncludeExts)+len(filter.ExcludeExts) == 0 &&
+		filter.IncludePattern == nil && filter.ExcludePattern == nil && filter.MinSize == 0 && filter.MaxSize == 0 {
+		return nil
+	}
+	return filter
+}
+
+// Returns the extractor of the text of attachments, or nil when not enabled.
+func textExtractor() *svc.TextExtractor {
+	if len(ExtractText) == 0 {
+		return nil
+	}
+	extractor := &svc.TextExtractor{
+		Types:         make(map[string]bool),
+		MaxSizes:      make(map[string]int64),
+		Timeout:       ExtractTextTimeout,
+		ExcerptLength: ExtractTextExcerpt,
+	}
+	supported := func(kind string) bool {
+		for _, t := range svc.ExtractTextTypes {
+			if t == kind {
+				return true
+			}
+		}
+		return false
+	}
+	for _, kind := range ExtractText {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch {
+		case kind == "all":
+			for _, t := range svc.ExtractTextTypes {
+				extractor.Types[t] = true
+			}
+		case supported(kind):
+			extractor.Types[kind] = true
+		default:
+			logger.Fatalf("Unsupported text extraction type: %s", kind)
+		}
+	}
+	for kind, value := range ExtractTextMaxSize {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if !supported(kind) {
+			logger.Fatalf("Unsupported text extraction type: %s", kind)
+		}
+		size, err := svc.ParseBytes(value)
+		if err != nil {
+			logger.Fatalf("Invalid --extract-text-max-size: %v", err)
+		}
+		extractor.MaxSizes[kind] = size
+	}
+	return extractor
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davidecavestro/gmail-exporter/logger"
+	"github.com/davidecavestro/gmail-exporter/svc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <dir>",
+	Short: "Verify the integrity of an export",
+	Long: `Hash again the files listed by the integrity manifest of an export (written through --integrity),
+reporting the missing, modified and extra ones. Exits with status 1 when any is found.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := svc.VerifyIntegrity(args[0])
+		if err != nil {
+			logger.Fatalf("Unable to verify export: %v", err)
+		}
+		for _, path := range report.Missing {
+			fmt.Printf("MISSING  %s\n", path)
+		}
+		for _, path := range report.Modified {
+			fmt.Printf("MODIFIED %s\n", path)
+		}
+		for _, path := range report.Extra {
+			fmt.Printf("EXTRA    %s\n", path)
+		}
+		fmt.Printf("%d files verified, %d missing, %d modified, %d extra\n",
+			report.Verified, len(report.Missing), len(report.Modified), len(report.Extra))
+		if !report.Ok() {
+			os.Exit(1)
+		}
+	},
+}
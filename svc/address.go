@@ -0,0 +1,139 @@
+package svc
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Decodes RFC 2047 encoded words, supporting any charset known to browsers.
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported charset %s: %v", charset, err)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// Parses an address list header value. Malformed entries are kept as
+// addresses without email, rather than failing the whole list.
+func ParseAddressList(value string) []*mail.Address {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if addresses, err := addressParser.ParseList(value); err == nil {
+		return addresses
+	}
+	ret := make([]*mail.Address, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if address, err := addressParser.Parse(entry); err == nil {
+			ret = append(ret, address)
+		} else {
+			ret = append(ret, &mail.Address{Name: DecodeHeader(entry)})
+		}
+	}
+	return ret
+}
+
+// Decodes RFC 2047 encoded words within a header value, returning it
+// unchanged when not decodable.
+func DecodeHeader(value string) string {
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// Parses the Date header of a message, returning the zero time when missing
+// or malformed.
+func ParseDateHeader(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	// some clients append a comment with the zone name
+	if i := strings.Index(value, "("); i > 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	if date, err := mail.ParseDate(value); err == nil {
+		return date
+	}
+	return time.Time{}
+}
+
+// Returns the lowercase domain of an email address.
+func EmailDomain(email string) string {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return strings.ToLower(email[at+1:])
+	}
+	return ""
+}
+
+// Returns the address as "Name <email>", or just the email, keeping the
+// name decoded and lowering the email case. Names are quoted when needed
+// to keep lists parsable.
+func FormatAddress(address *mail.Address) string {
+	email := strings.ToLower(address.Address)
+	name := address.Name
+	if strings.ContainsAny(name, `,;:"<>@()[]\`) && email != "" {
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	switch {
+	case address.Name == "":
+		return email
+	case email == "":
+		return address.Name
+	default:
+		return fmt.Sprintf("%s <%s>", name, email)
+	}
+}
+
+// Header roles of the addresses of a message.
+var addressRoles = []struct {
+	role   string
+	header string
+}{
+	{"from", "From"},
+	{"to", "To"},
+	{"cc", "Cc"},
+	{"bcc", "Bcc"},
+	{"reply_to", "Reply-To"},
+}
+
+// Name of the sheet listing the addresses of every message.
+const AddressesSheet = "Addresses"
+
+var addressesColumns = []string{"ID", "ROLE", "NAME", "EMAIL", "DOMAIN", "DATE"}
+
+// Returns the rows of the addresses sheet for a message: one for every
+// address and role.
+func addressRows(msg *ExportedMessage, dateStyle int, location *time.Location) [][]interface{} {
+	ret := make([][]interface{}, 0)
+	var date interface{}
+	if msg.InternalDate != 0 {
+		date = excelize.Cell{StyleID: dateStyle, Value: time.UnixMilli(msg.InternalDate).In(location)}
+	}
+	for _, role := range addressRoles {
+		for _, header := range GetHeaderValues(msg.Message, role.header) {
+			for _, address := range ParseAddressList(header) {
+				email := strings.ToLower(address.Address)
+				ret = append(ret, []interface{}{msg.Id, role.role, address.Name, email, EmailDomain(email), date})
+			}
+		}
+	}
+	return ret
+}
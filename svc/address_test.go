@@ -0,0 +1,151 @@
+package svc
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseAddressList(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  []*mail.Address
+	}{
+		{"  ", nil},
+		{"jane@example.com", []*mail.Address{{Address: "jane@example.com"}}},
+		{`"Doe, John" <john@example.com>, =?ISO-8859-1?Q?Jos=E9?= <jose@example.com>`, []*mail.Address{
+			{Name: "Doe, John", Address: "john@example.com"},
+			{Name: "José", Address: "jose@example.com"},
+		}},
+		// malformed entries are kept, without failing the others
+		{"Jane <jane@example.com>, undisclosed-recipients:, ,=?UTF-8?Q?caff=C3=A8?=", []*mail.Address{
+			{Name: "Jane", Address: "jane@example.com"},
+			{Name: "undisclosed-recipients:"},
+			{Name: "caffè"},
+		}},
+	} {
+		if got := ParseAddressList(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.value, test.want, got)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"=?UTF-8?B?Y2FmZsOo?=", "caffè"},
+		{"=?windows-1252?Q?=80?= 10", "€ 10"},
+		{"=?x-unknown?Q?abc?=", "=?x-unknown?Q?abc?="},
+	} {
+		if got := DecodeHeader(test.value); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.value, test.want, got)
+		}
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	for _, test := range []struct {
+		email string
+		want  string
+	}{
+		{"jane@Example.COM", "example.com"},
+		{`"a@b"@example.org`, "example.org"},
+		{"jane", ""},
+		{"", ""},
+	} {
+		if got := EmailDomain(test.email); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.email, test.want, got)
+		}
+	}
+}
+
+func TestFormatAddress(t *testing.T) {
+	for _, test := range []struct {
+		address *mail.Address
+		want    string
+	}{
+		{&mail.Address{Address: "Jane@Example.com"}, "jane@example.com"},
+		{&mail.Address{Name: "Jane Doe", Address: "jane@example.com"}, "Jane Doe <jane@example.com>"},
+		{&mail.Address{Name: "Doe, John", Address: "john@example.com"}, `"Doe, John" <john@example.com>`},
+		{&mail.Address{Name: `Say "hi"`, Address: "a@example.com"}, `"Say \"hi\"" <a@example.com>`},
+		{&mail.Address{Name: "Doe, John"}, "Doe, John"},
+	} {
+		got := FormatAddress(test.address)
+		if got != test.want {
+			t.Errorf("%v: expected %q, got %q", test.address, test.want, got)
+		}
+		// formatted lists can be parsed back
+		if test.address.Address != "" {
+			if parsed := ParseAddressList(got + ", b@example.com"); len(parsed) != 2 || parsed[0].Name != test.address.Name {
+				t.Errorf("%q: unexpected parsed list %v", got, parsed)
+			}
+		}
+	}
+}
+
+func TestAddressRows(t *testing.T) {
+	date := time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC)
+	msg := &ExportedMessage{Message: &gmail.Message{
+		Id:           "m1",
+		InternalDate: date.UnixMilli(),
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "Reply-To", Value: "list@example.org"},
+			{Name: "To", Value: "a@example.com, Bob <B@Example.org>"},
+			{Name: "From", Value: "Jane <jane@example.com>"},
+			{Name: "Cc", Value: "c@example.com"},
+			{Name: "Cc", Value: "d@example.com"},
+		}},
+	}}
+	cell := excelize.Cell{StyleID: 7, Value: date}
+	want := [][]interface{}{
+		{"m1", "from", "Jane", "jane@example.com", "example.com", cell},
+		{"m1", "to", "", "a@example.com", "example.com", cell},
+		{"m1", "to", "Bob", "b@example.org", "example.org", cell},
+		{"m1", "cc", "", "c@example.com", "example.com", cell},
+		{"m1", "cc", "", "d@example.com", "example.com", cell},
+		{"m1", "reply_to", "", "list@example.org", "example.org", cell},
+	}
+	if got := addressRows(msg, 7, time.UTC); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// no date cell without an internal date
+	msg.InternalDate = 0
+	msg.Payload.Headers = msg.Payload.Headers[2:3]
+	want = [][]interface{}{{"m1", "from", "Jane", "jane@example.com", "example.com", nil}}
+	if got := addressRows(msg, 7, time.UTC); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAddressesSheet(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject"})
+	opts := &SpreadsheetOptions{Columns: columns, AddressesSheet: true, Location: time.UTC}
+	msgs := []*gmail.Message{
+		testThreadMessage("m1", "t1", 0, "Jane <jane@example.com>", "a@example.com, b@example.com"),
+		testThreadMessage("m2", "t1", 1, "a@example.com", "Jane <jane@example.com>"),
+	}
+	file := testWorkbooks(t, opts, msgs...)[0]
+	rows, err := file.GetRows(AddressesSheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		addressesColumns,
+		{"m1", "from", "Jane", "jane@example.com", "example.com", "2023-01-31 10:00:00"},
+		{"m1", "to", "", "a@example.com", "example.com", "2023-01-31 10:00:00"},
+		{"m1", "to", "", "b@example.com", "example.com", "2023-01-31 10:00:00"},
+		{"m2", "from", "", "a@example.com", "example.com", "2023-01-31 10:01:00"},
+		{"m2", "to", "Jane", "jane@example.com", "example.com", "2023-01-31 10:01:00"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected %v, got %v", want, rows)
+	}
+}
@@ -0,0 +1,286 @@
+package svc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Entries listed by the top senders, recipients and biggest messages sheets.
+const analyticsTop = 20
+
+type bigMessage struct {
+	id       string
+	subject  string
+	from     string
+	received time.Time
+	size     int64
+}
+
+type attachmentTypeStats struct {
+	count int
+	size  int64
+}
+
+// analytics collects the statistics of the analytics sheets while exporting.
+type analytics struct {
+	location        *time.Location
+	senders         map[string]int
+	recipients      map[string]int
+	days            map[string]int
+	weeks           map[string]int
+	months          map[string]int
+	hours           [24]int
+	biggest         []*bigMessage
+	attachmentTypes map[string]*attachmentTypeStats
+}
+
+func newAnalytics(location *time.Location) *analytics {
+	return &analytics{
+		location:        location,
+		senders:         make(map[string]int),
+		recipients:      make(map[string]int),
+		days:            make(map[string]int),
+		weeks:           make(map[string]int),
+		months:          make(map[string]int),
+		attachmentTypes: make(map[string]*attachmentTypeStats),
+	}
+}
+
+func (a *analytics) add(msg *ExportedMessage) {
+	if addresses := ParseAddressList(GetHeader(msg.Message, "From")); len(addresses) > 0 && addresses[0].Address != "" {
+		a.senders[strings.ToLower(addresses[0].Address)]++
+	}
+	for _, address := range recipients(msg.Message) {
+		if address.Address != "" {
+			a.recipients[strings.ToLower(address.Address)]++
+		}
+	}
+
+	received := time.UnixMilli(msg.InternalDate).In(a.location)
+	a.days[received.Format("2006-01-02")]++
+	year, week := received.ISOWeek()
+	a.weeks[fmt.Sprintf("%04d-W%02d", year, week)]++
+	a.months[received.Format("2006-01")]++
+	a.hours[received.Hour()]++
+
+	// keeps just the biggest messages, sorted by size
+	a.biggest = append(a.biggest, &bigMessage{
+		id:       msg.Id,
+		subject:  DecodeHeader(GetHeader(msg.Message, "Subject")),
+		from:     DecodeHeader(GetHeader(msg.Message, "From")),
+		received: received,
+		size:     msg.SizeEstimate,
+	})
+	sort.SliceStable(a.biggest, func(i, j int) bool { return a.biggest[i].size > a.biggest[j].size })
+	if len(a.biggest) > analyticsTop {
+		a.biggest = a.biggest[:analyticsTop]
+	}
+
+	a.addAttachments(msg.Payload)
+}
+
+// Accounts the attachments found within the whole part tree.
+func (a *analytics) addAttachments(part *gmail.MessagePart) {
+	if part == nil {
+		return
+	}
+	if part.Filename != "" {
+		mimeType := strings.ToLower(part.MimeType)
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		stats, ok := a.attachmentTypes[mimeType]
+		if !ok {
+			stats = &attachmentTypeStats{}
+			a.attachmentTypes[mimeType] = stats
+		}
+		stats.count++
+		if part.Body != nil {
+			stats.size += part.Body.Size
+		}
+	}
+	for _, child := range part.Parts {
+		a.addAttachments(child)
+	}
+}
+
+// Returns the keys of counts sorted by decreasing count, then by key.
+func topKeys(counts map[string]int, limit int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Returns the keys of counts in ascending order.
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writes the analytics sheets, with their charts, through the non streaming
+// API.
+func (wb *workbook) writeAnalytics(a *analytics) error {
+	file := wb.file
+	sizeStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &sizeFormat})
+	if err != nil {
+		return err
+	}
+
+	countRows := func(keys []string, counts map[string]int) [][]interface{} {
+		rows := make([][]interface{}, 0, len(keys))
+		for _, key := range keys {
+			rows = append(rows, []interface{}{key, counts[key]})
+		}
+		return rows
+	}
+
+	sheet, err := wb.writeAnalyticsSheet("Top senders", []string{"SENDER", "MESSAGES"}, countRows(topKeys(a.senders, analyticsTop), a.senders))
+	if err != nil {
+		return err
+	}
+	if err := addAnalyticsChart(file, sheet, "bar", "Top senders", len(a.senders), analyticsTop); err != nil {
+		return err
+	}
+
+	if sheet, err = wb.writeAnalyticsSheet("Top recipients", []string{"RECIPIENT", "MESSAGES"}, countRows(topKeys(a.recipients, analyticsTop), a.recipients)); err != nil {
+		return err
+	}
+	if err := addAnalyticsChart(file, sheet, "bar", "Top recipients", len(a.recipients), analyticsTop); err != nil {
+		return err
+	}
+
+	for _, volume := range []struct {
+		name   string
+		title  string
+		counts map[string]int
+	}{
+		{"Messages per day", "DAY", a.days},
+		{"Messages per week", "WEEK", a.weeks},
+		{"Messages per month", "MONTH", a.months},
+	} {
+		if sheet, err = wb.writeAnalyticsSheet(volume.name, []string{volume.title, "MESSAGES"}, countRows(sortedKeys(volume.counts), volume.counts)); err != nil {
+			return err
+		}
+		if err := addAnalyticsChart(file, sheet, "line", volume.name, len(volume.counts), 0); err != nil {
+			return err
+		}
+	}
+
+	rows := make([][]interface{}, 0, len(a.biggest))
+	for _, msg := range a.biggest {
+		rows = append(rows, []interface{}{
+			msg.id, msg.subject, msg.from,
+			excelize.Cell{StyleID: wb.dateStyle, Value: msg.received},
+			excelize.Cell{StyleID: sizeStyle, Value: msg.size},
+		})
+	}
+	if _, err = wb.writeAnalyticsSheet("Biggest messages", []string{"ID", "SUBJECT", "FROM", "DATE", "SIZE"}, rows); err != nil {
+		return err
+	}
+
+	types := make([]string, 0, len(a.attachmentTypes))
+	for mimeType := range a.attachmentTypes {
+		types = append(types, mimeType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if a.attachmentTypes[types[i]].size != a.attachmentTypes[types[j]].size {
+			return a.attachmentTypes[types[i]].size > a.attachmentTypes[types[j]].size
+		}
+		return types[i] < types[j]
+	})
+	rows = make([][]interface{}, 0, len(types))
+	for _, mimeType := range types {
+		stats := a.attachmentTypes[mimeType]
+		rows = append(rows, []interface{}{mimeType, stats.count, excelize.Cell{StyleID: sizeStyle, Value: stats.size}})
+	}
+	if sheet, err = wb.writeAnalyticsSheet("Attachment types", []string{"MIME TYPE", "ATTACHMENTS", "SIZE"}, rows); err != nil {
+		return err
+	}
+	if err := addAnalyticsChart(file, sheet, "col", "Attachments by type", len(types), 0); err != nil {
+		return err
+	}
+
+	rows = make([][]interface{}, 0, len(a.hours))
+	for hour, count := range a.hours {
+		rows = append(rows, []interface{}{fmt.Sprintf("%02d:00", hour), count})
+	}
+	if sheet, err = wb.writeAnalyticsSheet("Busiest hours", []string{"HOUR", "MESSAGES"}, rows); err != nil {
+		return err
+	}
+	return addAnalyticsChart(file, sheet, "col", "Messages per hour", len(rows), 0)
+}
+
+// Writes a sheet with a header row, returning its name.
+func (wb *workbook) writeAnalyticsSheet(base string, titles []string, rows [][]interface{}) (string, error) {
+	file := wb.file
+	name := sheetName(base, 1)
+	for n := 2; file.GetSheetIndex(name) >= 0; n++ {
+		name = sheetName(fmt.Sprintf("%s %d", base, n), 1)
+	}
+	file.NewSheet(name)
+	headers := make([]interface{}, 0, len(titles))
+	for _, title := range titles {
+		headers = append(headers, excelize.Cell{StyleID: wb.headerStyle, Value: title})
+	}
+	if err := setSheetCells(file, name, 1, headers); err != nil {
+		return "", err
+	}
+	for i, row := range rows {
+		if err := setSheetCells(file, name, i+2, row); err != nil {
+			return "", err
+		}
+	}
+	lastCol, _ := excelize.ColumnNumberToName(len(titles))
+	if err := file.SetColWidth(name, "A", "A", 40); err != nil {
+		return "", err
+	}
+	return name, file.SetColWidth(name, "B", lastCol, 16)
+}
+
+// Adds a chart of the values of column B, labeled by column A, for at most
+// limit rows when limit is positive.
+func addAnalyticsChart(file *excelize.File, sheet string, chartType string, title string, rows int, limit int) error {
+	if limit > 0 && rows > limit {
+		rows = limit
+	}
+	if rows == 0 {
+		return nil
+	}
+	ref := "'" + strings.ReplaceAll(sheet, "'", "''") + "'"
+	format, err := json.Marshal(map[string]interface{}{
+		"type": chartType,
+		"series": []map[string]interface{}{{
+			"name":       fmt.Sprintf("%s!$B$1", ref),
+			"categories": fmt.Sprintf("%s!$A$2:$A$%d", ref, rows+1),
+			"values":     fmt.Sprintf("%s!$B$2:$B$%d", ref, rows+1),
+		}},
+		"title":     map[string]interface{}{"name": title},
+		"legend":    map[string]interface{}{"none": true},
+		"dimension": map[string]interface{}{"width": 720, "height": 400},
+	})
+	if err != nil {
+		return err
+	}
+	return file.AddChart(sheet, "E2", string(format))
+}
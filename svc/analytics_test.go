@@ -0,0 +1,129 @@
+package svc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestTopKeys(t *testing.T) {
+	counts := map[string]int{"b": 2, "a": 2, "c": 5, "d": 1}
+	for _, test := range []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"c", "a", "b", "d"}},
+		{2, []string{"c", "a"}},
+		{10, []string{"c", "a", "b", "d"}},
+	} {
+		if got := topKeys(counts, test.limit); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: expected %v, got %v", test.limit, test.want, got)
+		}
+	}
+	if got := sortedKeys(counts); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("unexpected sorted keys %v", got)
+	}
+}
+
+// Returns a message sent on a date, with an attachment of the given type
+// and size when not empty.
+func testAnalyticsMessage(id string, date time.Time, size int64, from, to, mimeType string) *gmail.Message {
+	msg := testThreadMessage(id, id, 0, from, to)
+	msg.InternalDate = date.UnixMilli()
+	msg.SizeEstimate = size
+	if mimeType != "" {
+		msg.Payload.Parts = []*gmail.MessagePart{
+			{MimeType: "text/plain"},
+			{MimeType: "multipart/mixed", Parts: []*gmail.MessagePart{
+				{Filename: "a", MimeType: mimeType, Body: &gmail.MessagePartBody{Size: size / 2}},
+			}},
+		}
+	}
+	return msg
+}
+
+func TestAnalyticsAdd(t *testing.T) {
+	a := newAnalytics(time.UTC)
+	for _, msg := range []*gmail.Message{
+		testAnalyticsMessage("m1", time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), 100, "Jane <Jane@example.com>", "a@example.com", "application/PDF"),
+		testAnalyticsMessage("m2", time.Date(2023, 1, 2, 9, 30, 0, 0, time.UTC), 300, "jane@example.com", "a@example.com, b@example.com", ""),
+		testAnalyticsMessage("m3", time.Date(2023, 2, 1, 23, 0, 0, 0, time.UTC), 200, "undisclosed", "", "image/png"),
+	} {
+		a.add(&ExportedMessage{Message: msg})
+	}
+	for _, test := range []struct {
+		name   string
+		counts map[string]int
+		want   map[string]int
+	}{
+		{"senders", a.senders, map[string]int{"jane@example.com": 2}},
+		{"recipients", a.recipients, map[string]int{"a@example.com": 2, "b@example.com": 1}},
+		{"days", a.days, map[string]int{"2023-01-01": 1, "2023-01-02": 1, "2023-02-01": 1}},
+		// 2023-01-01 belongs to the last ISO week of 2022
+		{"weeks", a.weeks, map[string]int{"2022-W52": 1, "2023-W01": 1, "2023-W05": 1}},
+		{"months", a.months, map[string]int{"2023-01": 2, "2023-02": 1}},
+	} {
+		if !reflect.DeepEqual(test.counts, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, test.counts)
+		}
+	}
+	if a.hours[9] != 2 || a.hours[23] != 1 {
+		t.Errorf("unexpected hours %v", a.hours)
+	}
+	ids := make([]string, 0)
+	for _, msg := range a.biggest {
+		ids = append(ids, msg.id)
+	}
+	if !reflect.DeepEqual(ids, []string{"m2", "m3", "m1"}) {
+		t.Errorf("expected the biggest messages first, got %v", ids)
+	}
+	if pdf := a.attachmentTypes["application/pdf"]; len(a.attachmentTypes) != 2 || pdf == nil || pdf.count != 1 || pdf.size != 50 {
+		t.Errorf("unexpected attachment types %v", a.attachmentTypes)
+	}
+}
+
+func TestAnalyticsBiggestLimit(t *testing.T) {
+	a := newAnalytics(time.UTC)
+	for i := 0; i < analyticsTop+5; i++ {
+		msg := testAnalyticsMessage(fmt.Sprint(i), time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), int64(i), "", "", "")
+		a.add(&ExportedMessage{Message: msg})
+	}
+	if len(a.biggest) != analyticsTop || a.biggest[0].size != analyticsTop+4 || a.biggest[analyticsTop-1].size != 5 {
+		t.Errorf("unexpected biggest messages, %d kept", len(a.biggest))
+	}
+}
+
+func TestAnalyticsSheets(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject"})
+	opts := &SpreadsheetOptions{Columns: columns, Analytics: true, Location: time.UTC}
+	file := testWorkbooks(t, opts,
+		testAnalyticsMessage("m1", time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), 100, "jane@example.com", "a@example.com", "application/pdf"),
+		testAnalyticsMessage("m2", time.Date(2023, 1, 2, 9, 0, 0, 0, time.UTC), 300, "bob@example.com", "a@example.com", ""),
+		testAnalyticsMessage("m3", time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC), 200, "jane@example.com", "a@example.com", ""),
+	)[0]
+	want := []string{"Sheet1", "Top senders", "Top recipients", "Messages per day", "Messages per week",
+		"Messages per month", "Biggest messages", "Attachment types", "Busiest hours"}
+	if sheets := file.GetSheetList(); !reflect.DeepEqual(sheets, want) {
+		t.Fatalf("expected %v, got %v", want, sheets)
+	}
+	for _, test := range []struct {
+		sheet string
+		want  [][]string
+	}{
+		{"Top senders", [][]string{{"SENDER", "MESSAGES"}, {"jane@example.com", "2"}, {"bob@example.com", "1"}}},
+		{"Messages per day", [][]string{{"DAY", "MESSAGES"}, {"2023-01-01", "1"}, {"2023-01-02", "2"}}},
+	} {
+		if rows, _ := file.GetRows(test.sheet); !reflect.DeepEqual(rows, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.sheet, test.want, rows)
+		}
+	}
+	if rows, _ := file.GetRows("Biggest messages"); len(rows) != 4 || rows[1][0] != "m2" {
+		t.Errorf("unexpected biggest messages %v", rows)
+	}
+	if rows, _ := file.GetRows("Busiest hours"); len(rows) != 25 || rows[10][1] != "2" {
+		t.Errorf("unexpected hours %v", rows)
+	}
+}
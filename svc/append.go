@@ -0,0 +1,481 @@
+package svc
+
+import (
+	"encoding/xml"
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/davidecavestro/gmail-exporter/logger"
+	"github.com/davidecavestro/gmail-exporter/ui"
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// appendSheet adds messages to the message sheets of an existing workbook,
+// matching columns by title. Columns unknown to the layout (i.e. added by
+// users) are kept untouched.
+type appendSheet struct {
+	wb *workbook
+	// message sheets in workbook order, rows are added to the last one
+	parts []*appendPart
+	// rows of the messages already present, by id
+	rows map[string]appendRow
+}
+
+// appendPart is a message sheet, either existing or added when the last one
+// reaches the row limit.
+type appendPart struct {
+	name string
+	// physical column of every layout column, from 1
+	cols    []int
+	nextRow int
+	// columns and rows of the sheet before appending
+	width   int
+	height  int
+	created bool
+}
+
+type appendRow struct {
+	part  *appendPart
+	rowID int
+}
+
+// Returns the sheets of the workbook holding message ids, along with their
+// headers.
+func findMessageSheets(file *excelize.File) ([]string, [][]string, error) {
+	names := make([]string, 0)
+	headers := make([][]string, 0)
+	for _, name := range file.GetSheetList() {
+		rows, err := file.Rows(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		var header []string
+		if rows.Next() {
+			if header, err = rows.Columns(); err != nil {
+				return nil, nil, err
+			}
+		}
+		rows.Close()
+		for _, title := range header {
+			if title == IdColumnTitle {
+				names = append(names, name)
+				headers = append(headers, header)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no sheet with a %s column", IdColumnTitle)
+	}
+	return names, headers, nil
+}
+
+func newAppendSheet(wb *workbook) (*appendSheet, error) {
+	names, headers, err := findMessageSheets(wb.file)
+	if err != nil {
+		return nil, err
+	}
+	as := &appendSheet{wb: wb, rows: make(map[string]appendRow)}
+	for i, name := range names {
+		if err := as.openPart(name, headers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return as, nil
+}
+
+// Collects the ids of an existing sheet, adding the columns it misses.
+func (as *appendSheet) openPart(name string, header []string) error {
+	wb := as.wb
+	part := &appendPart{name: name, width: len(header)}
+	titles := make(map[string]int)
+	for i, title := range header {
+		titles[title] = i + 1
+	}
+	// columns missing from the sheet are added after the existing ones
+	for _, col := range wb.layout {
+		pos, ok := titles[col.title()]
+		if !ok {
+			header = append(header, col.title())
+			pos = len(header)
+			titles[col.title()] = pos
+			axis, _ := excelize.CoordinatesToCellName(pos, 1)
+			if err := wb.file.SetCellValue(name, axis, col.title()); err != nil {
+				return err
+			}
+			if err := wb.file.SetCellStyle(name, axis, axis, wb.headerStyle); err != nil {
+				return err
+			}
+		}
+		part.cols = append(part.cols, pos)
+	}
+
+	idCol := titles[IdColumnTitle]
+	rows, err := wb.file.GetRows(name)
+	if err != nil {
+		return err
+	}
+	for i, row := range rows {
+		if i > 0 && idCol <= len(row) && row[idCol-1] != "" {
+			as.rows[row[idCol-1]] = appendRow{part: part, rowID: i + 1}
+		}
+	}
+	part.height = len(rows)
+	part.nextRow = len(rows) + 1
+	as.parts = append(as.parts, part)
+	return nil
+}
+
+var sheetPartPattern = regexp.MustCompile(`^(?:Sheet([0-9]+)|(.*) \(([0-9]+)\))$`)
+
+// Returns the base and the part a sheet has been named after, i.e. Sheet1 and
+// 3 for Sheet3, Work and 2 for "Work (2)".
+func sheetBase(name string) (string, int) {
+	match := sheetPartPattern.FindStringSubmatch(name)
+	switch {
+	case match == nil:
+		return name, 1
+	case match[1] != "":
+		part, _ := strconv.Atoi(match[1])
+		return "Sheet1", part
+	default:
+		part, _ := strconv.Atoi(match[3])
+		return match[2], part
+	}
+}
+
+// Continues on a new sheet after the last one, as sheetWriter does when
+// reaching the row limit.
+func (as *appendSheet) rollover() error {
+	wb := as.wb
+	base, n := sheetBase(as.parts[len(as.parts)-1].name)
+	name := sheetName(base, n+1)
+	for n += 2; wb.file.GetSheetIndex(name) >= 0; n++ {
+		name = sheetName(base, n)
+	}
+	wb.file.NewSheet(name)
+	part := &appendPart{name: name, nextRow: 2, width: len(wb.layout), created: true}
+	for i, col := range wb.layout {
+		part.cols = append(part.cols, i+1)
+		axis, _ := excelize.CoordinatesToCellName(i+1, 1)
+		if err := wb.file.SetCellValue(name, axis, col.title()); err != nil {
+			return err
+		}
+	}
+	lastHeader, _ := excelize.CoordinatesToCellName(len(wb.layout), 1)
+	if err := wb.file.SetCellStyle(name, "A1", lastHeader, wb.headerStyle); err != nil {
+		return err
+	}
+	as.parts = append(as.parts, part)
+	return nil
+}
+
+// Returns the physical row of the values of a layout row.
+func (part *appendPart) physical(row []interface{}) []interface{} {
+	ret := make([]interface{}, 0)
+	for i, value := range row {
+		for len(ret) < part.cols[i] {
+			ret = append(ret, nil)
+		}
+		ret[part.cols[i]-1] = value
+	}
+	return ret
+}
+
+// Adds a row to the last sheet, rolling over when the row limit has been
+// reached.
+func (as *appendSheet) add(row []interface{}) (appendRow, error) {
+	if as.parts[len(as.parts)-1].nextRow > as.wb.maxRows() {
+		if err := as.rollover(); err != nil {
+			return appendRow{}, err
+		}
+	}
+	part := as.parts[len(as.parts)-1]
+	if err := setSheetCells(as.wb.file, part.name, part.nextRow, part.physical(row)); err != nil {
+		return appendRow{}, err
+	}
+	part.nextRow++
+	return appendRow{part: part, rowID: part.nextRow - 1}, nil
+}
+
+// Refreshes the state columns of an existing row, returning whether any
+// value changed.
+func (as *appendSheet) update(row appendRow, msg *ExportedMessage) (bool, error) {
+	changed := false
+	for i, col := range as.wb.layout {
+		if !col.column.State {
+			continue
+		}
+		axis, _ := excelize.CoordinatesToCellName(row.part.cols[i], row.rowID)
+		current, err := as.wb.file.GetCellValue(row.part.name, axis)
+		if err != nil {
+			return false, err
+		}
+		value := col.column.Value(msg, as.wb.opts)
+		if cellString(value) == current {
+			continue
+		}
+		changed = true
+		// setting the value keeps the cell style
+		if err := as.wb.file.SetCellValue(row.part.name, axis, value); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+func cellString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Extends the tables of the existing sheets, decorates the added ones and
+// hides the id columns.
+func (as *appendSheet) finish() error {
+	file := as.wb.file
+	for _, part := range as.parts {
+		if part.created {
+			lastCell, _ := excelize.CoordinatesToCellName(len(as.wb.layout), part.nextRow-1)
+			if err := file.AddTable(part.name, "A1", lastCell, fmt.Sprintf(`{
+				"table_name": "%s",
+				"table_style": "TableStyleLight1",
+				"show_first_column": true,
+				"show_last_column": true,
+				"show_row_stripes": true,
+				"show_column_stripes": true
+			}`, uniqueTableName(file))); err != nil {
+				return err
+			}
+		} else if err := as.extendTable(part); err != nil {
+			return err
+		}
+		idCol, _ := excelize.ColumnNumberToName(part.cols[len(part.cols)-1])
+		if err := file.SetColVisible(part.name, idCol, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var tableRefPattern = regexp.MustCompile(`(<(?:table|autoFilter)\b[^>]*\bref=")A1:([A-Z]+)([0-9]+)(")`)
+var tableColumnsPattern = regexp.MustCompile(`<tableColumns count="([0-9]+)"`)
+var tableNamePattern = regexp.MustCompile(`<table\b[^>]*\bname="([^"]*)"`)
+
+// Names of the tables written by the export, see uniqueTableName.
+var exportTableNamePattern = regexp.MustCompile(`^table[0-9]*$`)
+
+// Extends the table the export decorated a sheet with to the appended rows
+// and to the added columns. Tables are edited within the package, as
+// excelize cannot resize them. Other tables (i.e. added by users) are left
+// untouched.
+func (as *appendSheet) extendTable(part *appendPart) error {
+	file := as.wb.file
+	header, err := file.GetRows(part.name)
+	if err != nil || len(header) == 0 {
+		return err
+	}
+	titles := header[0]
+	lastCol, _ := excelize.ColumnNumberToName(part.width)
+	expected := fmt.Sprintf("A1:%s%d", lastCol, part.height)
+	for _, path := range sheetTablePaths(file, part.name) {
+		value, ok := file.Pkg.Load(path)
+		if !ok {
+			continue
+		}
+		content := string(value.([]byte))
+		name := tableNamePattern.FindStringSubmatch(content)
+		if name == nil || !exportTableNamePattern.MatchString(name[1]) {
+			continue
+		}
+		match := tableRefPattern.FindStringSubmatch(content)
+		if match == nil || "A1:"+match[2]+match[3] != expected || !tableHasColumns(content, titles[:part.width]) {
+			return fmt.Errorf("table %s of sheet %s does not span the %s messages range, unable to extend it", name[1], part.name, expected)
+		}
+		if len(titles) > part.width {
+			columns := make([]string, 0)
+			count := part.width
+			if m := tableColumnsPattern.FindStringSubmatch(content); m != nil {
+				count, _ = strconv.Atoi(m[1])
+			}
+			for i, title := range titles[part.width:] {
+				columns = append(columns, fmt.Sprintf(`<tableColumn id="%d" name="%s"/>`, count+i+1, xmlEscape(title)))
+			}
+			content = strings.Replace(content, "</tableColumns>", strings.Join(columns, "")+"</tableColumns>", 1)
+			content = tableColumnsPattern.ReplaceAllString(content, fmt.Sprintf(`<tableColumns count="%d"`, count+len(columns)))
+		}
+		lastCol, _ := excelize.ColumnNumberToName(len(titles))
+		content = tableRefPattern.ReplaceAllString(content, fmt.Sprintf("${1}A1:%s%d${4}", lastCol, part.nextRow-1))
+		file.Pkg.Store(path, []byte(content))
+		return nil
+	}
+	return nil
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		Id     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// Returns the package path targeted by a relationship of the part at from.
+func (rels *xlsxRelationships) target(from string, id string) string {
+	for _, rel := range rels.Relationships {
+		if rel.Id == id {
+			if strings.HasPrefix(rel.Target, "/") {
+				return strings.TrimPrefix(rel.Target, "/")
+			}
+			return pathpkg.Join(pathpkg.Dir(from), rel.Target)
+		}
+	}
+	return ""
+}
+
+// Returns the relationships of the part at path, as loaded from the package.
+func readRelationships(file *excelize.File, path string) *xlsxRelationships {
+	rels := &xlsxRelationships{}
+	if data, ok := file.Pkg.Load(pathpkg.Join(pathpkg.Dir(path), "_rels", pathpkg.Base(path)+".rels")); ok {
+		xml.Unmarshal(data.([]byte), rels)
+	}
+	return rels
+}
+
+// Returns the package paths of the tables of a sheet loaded from file, as
+// excelize does not expose them.
+func sheetTablePaths(file *excelize.File, sheet string) []string {
+	const workbookPath = "xl/workbook.xml"
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			Id   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var worksheet struct {
+		TableParts []struct {
+			Id string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"tableParts>tablePart"`
+	}
+	data, ok := file.Pkg.Load(workbookPath)
+	if !ok || xml.Unmarshal(data.([]byte), &workbook) != nil {
+		return nil
+	}
+	sheetPath := ""
+	for _, s := range workbook.Sheets {
+		if s.Name == sheet {
+			sheetPath = readRelationships(file, workbookPath).target(workbookPath, s.Id)
+		}
+	}
+	if data, ok = file.Pkg.Load(sheetPath); !ok || xml.Unmarshal(data.([]byte), &worksheet) != nil {
+		return nil
+	}
+	rels := readRelationships(file, sheetPath)
+	paths := make([]string, 0, len(worksheet.TableParts))
+	for _, part := range worksheet.TableParts {
+		if path := rels.target(sheetPath, part.Id); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Returns a table name not used by the tables of the workbook.
+func uniqueTableName(file *excelize.File) string {
+	names := make(map[string]bool)
+	file.Pkg.Range(func(key, value interface{}) bool {
+		if path, ok := key.(string); ok && strings.HasPrefix(path, "xl/tables/") {
+			if match := tableNamePattern.FindSubmatch(value.([]byte)); match != nil {
+				names[string(match[1])] = true
+			}
+		}
+		return true
+	})
+	name := "table"
+	for n := 2; names[name]; n++ {
+		name = fmt.Sprintf("table%d", n)
+	}
+	return name
+}
+
+// Returns whether the table columns are named after titles.
+func tableHasColumns(table string, titles []string) bool {
+	for _, title := range titles {
+		if !strings.Contains(table, fmt.Sprintf(`name="%s"`, xmlEscape(title))) {
+			return false
+		}
+	}
+	return true
+}
+
+func xmlEscape(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(value)
+}
+
+// Adds the messages to an existing workbook: messages already present get
+// their state columns refreshed, the others are added as new rows.
+func appendMessages(
+	msgs chan *gmail.Message, pui *ui.ProgressUI,
+	saveMsgAttachments SaveMsgAttachments,
+	saveEml SaveEml, opts *SpreadsheetOptions, sinks ...MessageSink) {
+
+	wb := &workbook{opts: opts, file: opts.AppendTo, part: 1}
+	if err := wb.prepare(); err != nil {
+		logger.Fatalf("Unable to prepare xls file: %v", err)
+	}
+	sheet, err := newAppendSheet(wb)
+	if err != nil {
+		logger.Fatalf("Unable to append to xls file: %v", err)
+	}
+
+	added, updated := 0, 0
+	for msg := range msgs {
+		if ref, ok := sheet.rows[msg.Id]; ok {
+			textBody, htmlBody := GetBodies(msg.Payload)
+			changed, err := sheet.update(ref, &ExportedMessage{Message: msg, TextBody: textBody, HtmlBody: htmlBody})
+			if err != nil {
+				logger.Fatalf("Unable to update xls row: %v", err)
+			}
+			if changed {
+				updated++
+			}
+			pui.SpreadsheetIncrement()
+			continue
+		}
+
+		exported := exportMessage(msg, saveMsgAttachments, saveEml)
+		row, err := wb.row(exported)
+		if err != nil {
+			logger.Fatalf("Unable to prepare xls row: %v", err)
+		}
+		if sheet.rows[msg.Id], err = sheet.add(row); err != nil {
+			logger.Fatalf("Unable to set xls row: %v", err)
+		}
+		added++
+		for _, sink := range sinks {
+			if err := sink.Write(exported); err != nil {
+				logger.Fatalf("Unable to export message %s: %v", msg.Id, err)
+			}
+		}
+		pui.SpreadsheetIncrement()
+	}
+
+	if err := sheet.finish(); err != nil {
+		logger.Fatalf("Unable to complete xls sheets: %v", err)
+	}
+	if err := opts.SaveWorkbook(wb.file, 1); err != nil {
+		logger.Fatalf("Unable to save xls file: %v", err)
+	}
+	logger.Info(fmt.Sprintf("Appended %d messages, updated %d", added, updated))
+}
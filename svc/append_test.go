@@ -0,0 +1,184 @@
+package svc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/davidecavestro/gmail-exporter/ui"
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func testMessages(labelIds []string, ids ...string) chan *gmail.Message {
+	msgs := make(chan *gmail.Message, len(ids))
+	for _, id := range ids {
+		msgs <- &gmail.Message{
+			Id:       id,
+			ThreadId: id,
+			LabelIds: labelIds,
+			Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+				{Name: "Subject", Value: "subject " + id},
+			}},
+		}
+	}
+	close(msgs)
+	return msgs
+}
+
+// Exports the messages into a new workbook if file is nil, appending to it
+// otherwise, and returns the saved workbook as read back.
+func testExport(t *testing.T, file *excelize.File, msgs chan *gmail.Message, maxRows int) *excelize.File {
+	t.Helper()
+	columns, err := ParseColumns([]string{"subject", "unread"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved *excelize.File
+	opts := &SpreadsheetOptions{
+		Columns:  columns,
+		MaxRows:  maxRows,
+		AppendTo: file,
+		SaveWorkbook: func(file *excelize.File, part int) error {
+			buf, err := file.WriteToBuffer()
+			if err != nil {
+				return err
+			}
+			saved, err = excelize.OpenReader(buf)
+			return err
+		},
+	}
+	ExportMessages(msgs, 0, &ui.ProgressUI{Hide: true}, nil, nil, opts)
+	if saved == nil {
+		t.Fatal("workbook not saved")
+	}
+	return saved
+}
+
+// Returns the ids of the rows of every sheet, by sheet.
+func sheetIds(t *testing.T, file *excelize.File) map[string][]string {
+	t.Helper()
+	ret := make(map[string][]string)
+	for _, name := range file.GetSheetList() {
+		rows, err := file.GetRows(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idCol := -1
+		for i, title := range rows[0] {
+			if title == IdColumnTitle {
+				idCol = i
+			}
+		}
+		ids := make([]string, 0)
+		for _, row := range rows[1:] {
+			ids = append(ids, row[idCol])
+		}
+		ret[name] = ids
+	}
+	return ret
+}
+
+func TestAppendRollover(t *testing.T) {
+	// 3 messages per sheet, after the header
+	file := testExport(t, nil, testMessages([]string{"UNREAD"}, "a", "b", "c", "d", "e"), 4)
+	if ids := sheetIds(t, file); strings.Join(ids["Sheet2"], ",") != "d,e" {
+		t.Fatalf("unexpected sheets before appending: %v", ids)
+	}
+
+	// messages on later sheets are updated rather than added again
+	file = testExport(t, file, testMessages(nil, "e", "a", "f", "g"), 4)
+	ids := sheetIds(t, file)
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 sheets, got %v", ids)
+	}
+	expected := map[string]string{"Sheet1": "a,b,c", "Sheet2": "d,e,f", "Sheet3": "g"}
+	for name, want := range expected {
+		if got := strings.Join(ids[name], ","); got != want {
+			t.Errorf("sheet %s: expected %s, got %s", name, want, got)
+		}
+	}
+	for _, cell := range []struct{ sheet, axis, want string }{
+		{"Sheet1", "B2", "FALSE"}, // a, no longer unread
+		{"Sheet1", "B3", "TRUE"},  // b, untouched
+		{"Sheet2", "B3", "FALSE"}, // e, no longer unread
+	} {
+		if got, _ := file.GetCellValue(cell.sheet, cell.axis); got != cell.want {
+			t.Errorf("%s!%s: expected %s, got %s", cell.sheet, cell.axis, cell.want, got)
+		}
+	}
+}
+
+func TestAppendExtendTable(t *testing.T) {
+	file := testExport(t, nil, testMessages(nil, "a", "b"), 0)
+	file = testExport(t, file, testMessages(nil, "c"), 0)
+
+	paths := sheetTablePaths(file, "Sheet1")
+	if len(paths) != 1 {
+		t.Fatalf("expected a table, got %v", paths)
+	}
+	value, _ := file.Pkg.Load(paths[0])
+	if match := tableRefPattern.FindStringSubmatch(string(value.([]byte))); match == nil || match[2]+match[3] != "C4" {
+		t.Errorf("table not extended to the appended row: %v", match)
+	}
+}
+
+func TestAppendExtendTableChecks(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		table   *strings.Replacer
+		wantErr bool
+		wantRef string
+	}{
+		{"export table", strings.NewReplacer(), false, "A1:C4"},
+		{"unexpected range", strings.NewReplacer(`ref="A1:C3"`, `ref="A1:C2"`), true, ""},
+		{"user table", strings.NewReplacer(`name="table"`, `name="Totals"`, `ref="A1:C3"`, `ref="A1:C2"`), false, "A1:C2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			file := testExport(t, nil, testMessages(nil, "a", "b"), 0)
+			path := sheetTablePaths(file, "Sheet1")[0]
+			value, _ := file.Pkg.Load(path)
+			file.Pkg.Store(path, []byte(test.table.Replace(string(value.([]byte)))))
+
+			columns, _ := ParseColumns([]string{"subject", "unread"})
+			wb := &workbook{opts: &SpreadsheetOptions{Columns: columns}, file: file, part: 1}
+			if err := wb.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			as, err := newAppendSheet(wb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// as a row has been added
+			as.parts[0].nextRow++
+			if err := as.extendTable(as.parts[0]); (err != nil) != test.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if test.wantErr {
+				return
+			}
+			value, _ = file.Pkg.Load(path)
+			if match := tableRefPattern.FindStringSubmatch(string(value.([]byte))); match == nil || "A1:"+match[2]+match[3] != test.wantRef {
+				t.Errorf("expected %s, got %v", test.wantRef, match)
+			}
+		})
+	}
+}
+
+func TestSheetBase(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		base string
+		part int
+	}{
+		{"Sheet1", "Sheet1", 1},
+		{"Sheet3", "Sheet1", 3},
+		{"Work", "Work", 1},
+		{"Work (2)", "Work", 2},
+		{"Sheet", "Sheet", 1},
+	} {
+		base, part := sheetBase(test.name)
+		if base != test.base || part != test.part {
+			t.Errorf("%s: expected %s %d, got %s %d", test.name, test.base, test.part, base, part)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Renders the archive index from ARCHIVE_DATA, keeping the state in the url hash
+// so that views can be linked (i.e. from message pages to their thread).
+(function () {
+  "use strict";
+
+  var data = window.ARCHIVE_DATA || [];
+  var state = { view: "messages", label: "", thread: "", q: "", sort: "date", desc: true };
+
+  var columns = {
+    messages: [
+      { key: "date", title: "Date", render: function (m) { return fmtDate(m.date); } },
+      { key: "from", title: "From" },
+      { key: "to", title: "To" },
+      { key: "subject", title: "Subject", render: function (m) {
+        return '<a href="' + esc(m.page) + '">' + esc(m.subject || "(no subject)") + "</a>";
+      } },
+      { key: "labels", title: "Labels", render: function (m) { return labelLinks(m.labels); } },
+      { key: "attachments", title: "Att." },
+      { key: "size", title: "Size", render: function (m) { return fmtSize(m.size); } }
+    ],
+    threads: [
+      { key: "last", title: "Last", render: function (t) { return fmtDate(t.last); } },
+      { key: "first", title: "First", render: function (t) { return fmtDate(t.first); } },
+      { key: "subject", title: "Subject", render: function (t) {
+        return '<a href="#view=messages&thread=' + encodeURIComponent(t.thread) + '">' + esc(t.subject || "(no subject)") + "</a>";
+      } },
+      { key: "participants", title: "Participants" },
+      { key: "count", title: "Messages" }
+    ],
+    labels: [
+      { key: "name", title: "Label", render: function (l) {
+        return '<a href="#view=messages&label=' + encodeURIComponent(l.name) + '">' + esc(l.name) + "</a>";
+      } },
+      { key: "count", title: "Messages" },
+      { key: "size", title: "Size", render: function (l) { return fmtSize(l.size); } }
+    ]
+  };
+
+  function esc(s) {
+    return String(s === undefined || s === null ? "" : s).replace(/[&<>"']/g, function (c) {
+      return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+    });
+  }
+
+  function fmtDate(ms) {
+    var d = new Date(ms);
+    return isNaN(d) ? "" : d.toISOString().replace("T", " ").substring(0, 16);
+  }
+
+  function fmtSize(bytes) {
+    var units = ["B", "KB", "MB", "GB"];
+    var i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+      bytes /= 1024;
+      i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+  }
+
+  function labelLinks(labels) {
+    return (labels || []).map(function (l) {
+      return '<a class="label" href="#view=messages&label=' + encodeURIComponent(l) + '">' + esc(l) + "</a>";
+    }).join(" ");
+  }
+
+  function readHash() {
+    var params = {};
+    location.hash.replace(/^#/, "").split("&").forEach(function (pair) {
+      if (pair) {
+        var kv = pair.split("=");
+        params[decodeURIComponent(kv[0])] = decodeURIComponent(kv.slice(1).join("="));
+      }
+    });
+    state.view = columns[params.view] ? params.view : (params.thread ? "messages" : state.view);
+    state.label = params.label || "";
+    state.thread = params.thread || "";
+    state.q = params.q || "";
+  }
+
+  function writeHash() {
+    var parts = ["view=" + state.view];
+    ["label", "thread", "q"].forEach(function (k) {
+      if (state[k]) {
+        parts.push(k + "=" + encodeURIComponent(state[k]));
+      }
+    });
+    history.replaceState(null, "", "#" + parts.join("&"));
+  }
+
+  function matches(m) {
+    if (state.label && (m.labels || []).indexOf(state.label) < 0) {
+      return false;
+    }
+    if (state.thread && m.thread !== state.thread) {
+      return false;
+    }
+    if (state.q) {
+      var haystack = [m.subject, m.from, m.to, m.snippet, m.text].join("\n").toLowerCase();
+      return state.q.toLowerCase().split(/\s+/).every(function (term) {
+        return haystack.indexOf(term) >= 0;
+      });
+    }
+    return true;
+  }
+
+  function threads(msgs) {
+    var byId = {};
+    var ret = [];
+    msgs.forEach(function (m) {
+      var t = byId[m.thread];
+      if (!t) {
+        t = byId[m.thread] = { thread: m.thread, subject: m.subject, first: m.date, last: m.date, count: 0, people: {} };
+        ret.push(t);
+      }
+      t.count++;
+      if (m.date < t.first) {
+        t.first = m.date;
+        t.subject = m.subject;
+      }
+      t.last = Math.max(t.last, m.date);
+      t.people[m.from] = true;
+    });
+    ret.forEach(function (t) {
+      t.participants = Object.keys(t.people).join(", ");
+    });
+    return ret;
+  }
+
+  function labels(msgs) {
+    var byName = {};
+    msgs.forEach(function (m) {
+      (m.labels || []).forEach(function (name) {
+        var l = byName[name] || (byName[name] = { name: name, count: 0, size: 0 });
+        l.count++;
+        l.size += m.size;
+      });
+    });
+    return Object.keys(byName).map(function (k) { return byName[k]; });
+  }
+
+  function sorted(rows) {
+    var key = state.sort;
+    return rows.slice().sort(function (a, b) {
+      var x = a[key], y = b[key];
+      if (Array.isArray(x)) { x = x.join(","); y = y.join(","); }
+      if (typeof x === "string") { x = x.toLowerCase(); y = (y || "").toLowerCase(); }
+      var cmp = x < y ? -1 : (x > y ? 1 : 0);
+      return state.desc ? -cmp : cmp;
+    });
+  }
+
+  function render() {
+    var msgs = data.filter(matches);
+    var rows = state.view === "threads" ? threads(msgs) : (state.view === "labels" ? labels(msgs) : msgs);
+    var cols = columns[state.view];
+    if (!cols.some(function (c) { return c.key === state.sort; })) {
+      state.sort = cols[0].key;
+    }
+
+    document.querySelector("#list thead").innerHTML = "<tr>" + cols.map(function (c) {
+      var mark = c.key === state.sort ? (state.desc ? " &#9660;" : " &#9650;") : "";
+      return '<th data-key="' + c.key + '">' + esc(c.title) + mark + "</th>";
+    }).join("") + "</tr>";
+    document.querySelector("#list tbody").innerHTML = sorted(rows).map(function (row) {
+      return "<tr>" + cols.map(function (c) {
+        return "<td>" + (c.render ? c.render(row) : esc(row[c.key])) + "</td>";
+      }).join("") + "</tr>";
+    }).join("");
+    document.getElementById("empty").hidden = rows.length > 0;
+
+    document.querySelectorAll(".views a").forEach(function (a) {
+      a.className = a.getAttribute("data-view") === state.view ? "active" : "";
+    });
+    document.getElementById("label").value = state.label;
+    document.getElementById("search").value = state.q;
+    document.getElementById("filters").innerHTML = state.thread
+      ? 'Thread ' + esc(state.thread) + ' <a href="#view=messages">clear</a>' : "";
+  }
+
+  function init() {
+    var select = document.getElementById("label");
+    labels(data).map(function (l) { return l.name; }).sort().forEach(function (name) {
+      var option = document.createElement("option");
+      option.value = option.textContent = name;
+      select.appendChild(option);
+    });
+    select.addEventListener("change", function () {
+      state.label = select.value;
+      writeHash();
+      render();
+    });
+    var search = document.getElementById("search");
+    search.addEventListener("input", function () {
+      state.q = search.value.trim();
+      writeHash();
+      render();
+    });
+    document.querySelector("#list thead").addEventListener("click", function (e) {
+      var key = e.target.getAttribute("data-key");
+      if (key) {
+        state.desc = key === state.sort ? !state.desc : false;
+        state.sort = key;
+        render();
+      }
+    });
+    window.addEventListener("hashchange", function () {
+      readHash();
+      render();
+    });
+    readHash();
+    render();
+  }
+
+  init();
+})();
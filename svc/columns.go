@@ -0,0 +1,343 @@
+package svc
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Column of the spreadsheet, extracting a cell value from every exported
+// message.
+type Column struct {
+	// Name used to select the column, i.e. within --columns
+	Name  string
+	Title string
+	// Optional cell style, i.e. for number formats
+	Style *excelize.Style
+	// Whether values can exceed the cell limit, i.e. bodies
+	Long bool
+	// Whether values reflect the message state, refreshed when appending
+	State bool
+	Value func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{}
+}
+
+var dateTimeFormat = "yyyy-mm-dd hh:mm:ss"
+
+// Decimal units, as number formats can only scale by thousands.
+var sizeFormat = `[<1000]0" B";[<1000000]0.0," KB";0.0,," MB"`
+
+// Prefix selecting a column for an arbitrary header, i.e. header:X-Mailer
+const HeaderColumnPrefix = "header:"
+
+// Columns exported when not differently specified.
+var DefaultColumns = []string{
+	"from", "to", "size", "date", "date_internal", "thread", "subject", "snippet",
+	"text_body", "html_body", "eml", "attachment_list",
+	"attachment1", "attachment2", "attachment3", "attachment4",
+}
+
+// Title of the hidden column identifying messages, always added to sheets.
+const IdColumnTitle = "GMAIL ID"
+
+var idColumn = &Column{Name: "gmail_id", Title: IdColumnTitle, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+	return msg.Id
+}}
+
+var hyperlinkStyle = &excelize.Style{Font: &excelize.Font{Color: "#1265BE", Underline: "single"}}
+
+// Excel limit for the HYPERLINK link location
+const maxHyperlinkLength = 255
+
+// Returns a cell linking to target, showing label. Falls back on the plain
+// label when the link cannot be represented.
+func hyperlinkCell(target string, label string) interface{} {
+	if target == "" {
+		return nil
+	}
+	if len(target) > maxHyperlinkLength {
+		return label
+	}
+	quote := strings.NewReplacer(`"`, `""`).Replace
+	return excelize.Cell{
+		Formula: fmt.Sprintf(`HYPERLINK("%s","%s")`, quote(target), quote(label)),
+		Value:   label,
+	}
+}
+
+// Returns a cell linking to a file written to the output, relative to the
+// workbook location so that the whole export can be moved.
+func fileLinkCell(filename string, opts *SpreadsheetOptions) interface{} {
+	if filename == "" {
+		return nil
+	}
+	target := filename
+	if opts.WorkbookDir != "" && filepath.IsAbs(opts.WorkbookDir) == filepath.IsAbs(filename) {
+		if rel, err := filepath.Rel(opts.WorkbookDir, filename); err == nil {
+			target = rel
+		}
+	}
+	return hyperlinkCell(filepath.ToSlash(target), filename)
+}
+
+var attachmentColumnPattern = regexp.MustCompile(`^attachment([1-9][0-9]*)$`)
+
+// Returns all the values of a header, for headers that can be repeated.
+func GetHeaderValues(msg *gmail.Message, name string) []string {
+	ret := make([]string, 0)
+	if msg.Payload == nil {
+		return ret
+	}
+	for _, h := range msg.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			ret = append(ret, h.Value)
+		}
+	}
+	return ret
+}
+
+// Columns of header values, decoded for display as address headers of
+// messages fetched raw are kept encoded.
+func headerColumn(title string, header string) *Column {
+	return &Column{Title: title, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		values := GetHeaderValues(msg.Message, header)
+		for i, value := range values {
+			values[i] = DecodeHeader(value)
+		}
+		return strings.Join(values, ", ")
+	}}
+}
+
+var builtinColumns = map[string]*Column{
+	"id":          {Title: "ID", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.Id }},
+	"from":        headerColumn("FROM", "From"),
+	"to":          headerColumn("TO", "To"),
+	"cc":          headerColumn("CC", "Cc"),
+	"bcc":         headerColumn("BCC", "Bcc"),
+	"reply_to":    headerColumn("REPLY TO", "Reply-To"),
+	"message_id":  headerColumn("MESSAGE ID", "Message-ID"),
+	"in_reply_to": headerColumn("IN REPLY TO", "In-Reply-To"),
+	"references":  headerColumn("REFERENCES", "References"),
+	"list_id":     headerColumn("LIST ID", "List-Id"),
+	"size": {Title: "SIZE", Style: &excelize.Style{CustomNumFmt: &sizeFormat},
+		Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.SizeEstimate }},
+	// falls back on the header value when not parsable
+	"date": {Title: "DATE", Style: &excelize.Style{CustomNumFmt: &dateTimeFormat},
+		Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+			header := GetHeader(msg.Message, "Date")
+			if date := ParseDateHeader(header); !date.IsZero() {
+				return date.In(opts.location())
+			}
+			return header
+		}},
+	"date_header": headerColumn("DATE HEADER", "Date"),
+	"date_internal": {Title: "DATE INTERNAL", Style: &excelize.Style{CustomNumFmt: &dateTimeFormat},
+		Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+			return time.UnixMilli(msg.InternalDate).In(opts.location())
+		}},
+	"thread":    {Title: "THREAD", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.ThreadId }},
+	"subject":   headerColumn("SUBJECT", "Subject"),
+	"snippet":   {Title: "SNIPPET", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.Snippet }},
+	"text_body": {Title: "TEXT BODY", Long: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.TextBody }},
+	"html_body": {Title: "HTML BODY", Long: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return msg.HtmlBody }},
+	"eml": {Title: "EML", Style: hyperlinkStyle,
+		Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} { return fileLinkCell(msg.Eml, opts) }},
+	// deep link to the message within the gmail web UI
+	"gmail_link": {Title: "GMAIL LINK", Style: hyperlinkStyle,
+		Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+			account := opts.Account
+			if account == "" {
+				account = "0"
+			}
+			return hyperlinkCell(fmt.Sprintf("https://mail.google.com/mail/u/%s/#all/%s", url.PathEscape(account), msg.Id), "Open in Gmail")
+		}},
+	"sender_name": senderColumn("SENDER NAME", func(address *mail.Address) string { return address.Name }),
+	"sender_email": senderColumn("SENDER EMAIL", func(address *mail.Address) string {
+		return strings.ToLower(address.Address)
+	}),
+	"sender_domain": senderColumn("SENDER DOMAIN", func(address *mail.Address) string { return EmailDomain(address.Address) }),
+	"recipient_count": {Title: "RECIPIENT COUNT", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		return len(recipients(msg.Message))
+	}},
+	"recipients": {Title: "RECIPIENTS", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		list := make([]string, 0)
+		for _, address := range recipients(msg.Message) {
+			list = append(list, FormatAddress(address))
+		}
+		return strings.Join(list, ", ")
+	}},
+	"labels":      {Title: "LABELS", State: true, Value: labelsValue(false)},
+	"user_labels": {Title: "USER LABELS", State: true, Value: labelsValue(true)},
+	"label_ids": {Title: "LABEL IDS", State: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		return strings.Join(msg.LabelIds, ", ")
+	}},
+	"unread":    labelFlagColumn("UNREAD", "UNREAD"),
+	"starred":   labelFlagColumn("STARRED", "STARRED"),
+	"important": labelFlagColumn("IMPORTANT", "IMPORTANT"),
+	"spam":      labelFlagColumn("SPAM", "SPAM"),
+	"trash":     labelFlagColumn("TRASH", "TRASH"),
+	"category": {Title: "CATEGORY", State: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		for _, labelId := range msg.LabelIds {
+			if category, ok := categoryNames[labelId]; ok {
+				return category
+			}
+		}
+		return nil
+	}},
+	"attachment_names": {Title: "ATTACHMENT NAMES", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		names := []string{}
+		for _, attachment := range msg.Attachments {
+			if attachment != nil {
+				names = append(names, attachment.OriginalFilename)
+			}
+		}
+		return strings.Join(names, ", ")
+	}},
+	// excerpts of the text extracted from attachments
+	"attachment_text": {Title: "ATTACHMENT TEXT", Long: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		texts := []string{}
+		for _, attachment := range SavedAttachments(msg.Attachments) {
+			if attachment.TextExcerpt != "" {
+				texts = append(texts, fmt.Sprintf("%s: %s", attachment.OriginalFilename, attachment.TextExcerpt))
+			}
+		}
+		return strings.Join(texts, "\n\n")
+	}},
+	"attachment_list": {Title: "ATTACHMENT LIST", Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		attachmentCsv := []string{}
+		for _, attachment := range msg.Attachments {
+			if attachment != nil {
+				attachmentCsv = append(attachmentCsv, attachmentLabel(attachment))
+			}
+		}
+		return strings.Join(attachmentCsv, ",")
+	}},
+}
+
+// Returns a column for a property of the first From address.
+func senderColumn(title string, property func(address *mail.Address) string) *Column {
+	return &Column{Title: title, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		if addresses := ParseAddressList(GetHeader(msg.Message, "From")); len(addresses) > 0 {
+			return property(addresses[0])
+		}
+		return nil
+	}}
+}
+
+// Returns the To, Cc and Bcc addresses of a message.
+func recipients(msg *gmail.Message) []*mail.Address {
+	ret := make([]*mail.Address, 0)
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range GetHeaderValues(msg, header) {
+			ret = append(ret, ParseAddressList(value)...)
+		}
+	}
+	return ret
+}
+
+// Inbox categories, by label id.
+var categoryNames = map[string]string{
+	"CATEGORY_PERSONAL":   "Primary",
+	"CATEGORY_SOCIAL":     "Social",
+	"CATEGORY_PROMOTIONS": "Promotions",
+	"CATEGORY_UPDATES":    "Updates",
+	"CATEGORY_FORUMS":     "Forums",
+}
+
+// Returns whether a message carries a label.
+func hasLabel(msg *gmail.Message, labelId string) bool {
+	for _, id := range msg.LabelIds {
+		if id == labelId {
+			return true
+		}
+	}
+	return false
+}
+
+func labelFlagColumn(title string, labelId string) *Column {
+	return &Column{Title: title, State: true, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		return hasLabel(msg.Message, labelId)
+	}}
+}
+
+// Returns the label names of a message, optionally just the user defined
+// ones.
+func labelsValue(userOnly bool) func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+	return func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		labelIds := msg.LabelIds
+		if userOnly {
+			labelIds = make([]string, 0, len(msg.LabelIds))
+			for _, labelId := range msg.LabelIds {
+				if strings.HasPrefix(labelId, "Label_") {
+					labelIds = append(labelIds, labelId)
+				}
+			}
+		}
+		return strings.Join(GetLabelNamesOf(opts.LabelNames, labelIds), ", ")
+	}
+}
+
+// Returns the path of a saved attachment, or its name along with the reason
+// it has been skipped.
+func attachmentLabel(attachment *LocalAttachment) string {
+	if attachment.Skipped != "" {
+		return fmt.Sprintf("%s (skipped: %s)", attachment.OriginalFilename, attachment.Skipped)
+	}
+	return attachment.Filename
+}
+
+func attachmentColumn(name string, pos int) *Column {
+	return &Column{Name: name, Title: fmt.Sprintf("ATTACHMENT%d", pos), Style: hyperlinkStyle, Value: func(msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+		attachments := RemoveNils(append(make([]*LocalAttachment, 0, len(msg.Attachments)), msg.Attachments...))
+		if pos <= len(attachments) {
+			if attachments[pos-1].Skipped != "" {
+				return attachmentLabel(attachments[pos-1])
+			}
+			return fileLinkCell(attachments[pos-1].Filename, opts)
+		}
+		return nil
+	}}
+}
+
+// Returns the columns selected by a spec: a list of built-in column names,
+// or headers selected through the header: prefix.
+func ParseColumns(spec []string) ([]*Column, error) {
+	if len(spec) == 0 {
+		spec = DefaultColumns
+	}
+	ret := make([]*Column, 0, len(spec))
+	titles := make(map[string]bool)
+	for _, name := range spec {
+		name = strings.TrimSpace(name)
+		var column *Column
+		if strings.HasPrefix(strings.ToLower(name), HeaderColumnPrefix) {
+			header := strings.TrimSpace(name[len(HeaderColumnPrefix):])
+			if header == "" {
+				return nil, fmt.Errorf("missing header name for column '%s'", name)
+			}
+			column = headerColumn(strings.ToUpper(header), header)
+			column.Name = name
+		} else if match := attachmentColumnPattern.FindStringSubmatch(strings.ToLower(name)); match != nil {
+			pos, _ := strconv.Atoi(match[1])
+			column = attachmentColumn(name, pos)
+		} else if builtin, ok := builtinColumns[strings.ToLower(name)]; ok {
+			column = &Column{Name: strings.ToLower(name), Title: builtin.Title, Style: builtin.Style, Long: builtin.Long, State: builtin.State, Value: builtin.Value}
+		} else {
+			return nil, fmt.Errorf("unknown column '%s'", name)
+		}
+		// table headers must be unique
+		if titles[strings.ToUpper(column.Title)] || strings.EqualFold(column.Title, IdColumnTitle) {
+			return nil, fmt.Errorf("duplicated column '%s'", name)
+		}
+		titles[strings.ToUpper(column.Title)] = true
+		ret = append(ret, column)
+	}
+	return ret, nil
+}
@@ -0,0 +1,311 @@
+package svc
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidecavestro/gmail-exporter/ui"
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func testColumnMessage() *ExportedMessage {
+	return &ExportedMessage{Message: &gmail.Message{
+		Id:           "m1",
+		ThreadId:     "t1",
+		InternalDate: time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC).UnixMilli(),
+		SizeEstimate: 2048,
+		LabelIds:     []string{"INBOX", "UNREAD", "Label_1", "CATEGORY_UPDATES"},
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "Jane Doe <Jane@Example.com>"},
+			{Name: "To", Value: "a@example.com, =?UTF-8?Q?Doe=2C_John?= <john@example.org>"},
+			{Name: "Cc", Value: "c@example.com"},
+			{Name: "Date", Value: "Tue, 31 Jan 2023 23:30:00 +0000 (UTC)"},
+			{Name: "Subject", Value: "=?UTF-8?Q?caff=C3=A8?="},
+			{Name: "Received", Value: "first"},
+			{Name: "Received", Value: "second"},
+		}},
+	}}
+}
+
+// Returns the value of a single column for a message.
+func testColumnValue(t *testing.T, name string, msg *ExportedMessage, opts *SpreadsheetOptions) interface{} {
+	t.Helper()
+	columns, err := ParseColumns([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return columns[0].Value(msg, opts)
+}
+
+// Exports the messages, returning every saved workbook as read back.
+func testWorkbooks(t *testing.T, opts *SpreadsheetOptions, msgs ...*gmail.Message) []*excelize.File {
+	t.Helper()
+	ch := make(chan *gmail.Message, len(msgs))
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	saved := make([]*excelize.File, 0)
+	opts.SaveWorkbook = func(file *excelize.File, part int) error {
+		if part != len(saved)+1 {
+			t.Errorf("unexpected part %d", part)
+		}
+		buf, err := file.WriteToBuffer()
+		if err != nil {
+			return err
+		}
+		f, err := excelize.OpenReader(buf)
+		saved = append(saved, f)
+		return err
+	}
+	ExportMessages(ch, int64(len(msgs)), &ui.ProgressUI{Hide: true}, nil, nil, opts)
+	return saved
+}
+
+func TestParseColumns(t *testing.T) {
+	for _, test := range []struct {
+		spec    []string
+		want    []string
+		wantErr bool
+	}{
+		{nil, []string{"FROM", "TO", "SIZE", "DATE", "DATE INTERNAL", "THREAD", "SUBJECT", "SNIPPET",
+			"TEXT BODY", "HTML BODY", "EML", "ATTACHMENT LIST",
+			"ATTACHMENT1", "ATTACHMENT2", "ATTACHMENT3", "ATTACHMENT4"}, false},
+		{[]string{" From ", "header:X-Mailer", "attachment12"}, []string{"FROM", "X-MAILER", "ATTACHMENT12"}, false},
+		{[]string{"unknown"}, nil, true},
+		{[]string{"header: "}, nil, true},
+		{[]string{"attachment0"}, nil, true},
+		{[]string{"from", "FROM"}, nil, true},
+		{[]string{"from", "header:from"}, nil, true},
+		{[]string{"header:GMAIL ID"}, nil, true},
+	} {
+		columns, err := ParseColumns(test.spec)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: unexpected error %v", test.spec, err)
+			continue
+		}
+		titles := make([]string, 0)
+		for _, column := range columns {
+			titles = append(titles, column.Title)
+		}
+		if !test.wantErr && !reflect.DeepEqual(titles, test.want) {
+			t.Errorf("%v: expected %v, got %v", test.spec, test.want, titles)
+		}
+	}
+}
+
+func TestHeaderColumns(t *testing.T) {
+	msg := testColumnMessage()
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"subject", "caffè"},
+		{"to", "a@example.com, Doe, John <john@example.org>"},
+		{"header:received", "first, second"},
+		{"header:X-Missing", ""},
+		{"date_header", "Tue, 31 Jan 2023 23:30:00 +0000 (UTC)"},
+	} {
+		if got := testColumnValue(t, test.name, msg, &SpreadsheetOptions{}); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestDateColumns(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+	opts := &SpreadsheetOptions{Location: location}
+	msg := testColumnMessage()
+	want := time.Date(2023, 2, 1, 0, 30, 0, 0, location)
+	for _, name := range []string{"date", "date_internal"} {
+		got, ok := testColumnValue(t, name, msg, opts).(time.Time)
+		if !ok || !got.Equal(want) || got.Location() != location {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+	// malformed dates are kept as text
+	msg.Payload.Headers[3].Value = "yesterday"
+	if got := testColumnValue(t, "date", msg, opts); got != "yesterday" {
+		t.Errorf("expected the header value, got %v", got)
+	}
+}
+
+func TestParseDateHeader(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"Tue, 31 Jan 2023 23:30:00 +0100", time.Date(2023, 1, 31, 22, 30, 0, 0, time.UTC)},
+		{"31 Jan 2023 23:30:00 +0000 (UTC)", time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC)},
+		{"", time.Time{}},
+		{"not a date", time.Time{}},
+	} {
+		if got := ParseDateHeader(test.value); !got.Equal(test.want) {
+			t.Errorf("%q: expected %v, got %v", test.value, test.want, got)
+		}
+	}
+}
+
+func TestDateAndSizeCells(t *testing.T) {
+	columns, _ := ParseColumns([]string{"date_internal", "size"})
+	file := testWorkbooks(t, &SpreadsheetOptions{Columns: columns, Location: time.UTC}, testColumnMessage().Message)[0]
+	for _, test := range []struct {
+		axis string
+		raw  string
+	}{
+		// days since 1900, as Excel dates
+		{"A2", "44957.97"},
+		{"B2", "2048"},
+	} {
+		raw, _ := file.GetCellValue("Sheet1", test.axis, excelize.Options{RawCellValue: true})
+		if !strings.HasPrefix(raw, test.raw) {
+			t.Errorf("%s: expected the number %s, got %s", test.axis, test.raw, raw)
+		}
+		if style, _ := file.GetCellStyle("Sheet1", test.axis); style == 0 {
+			t.Errorf("%s: expected a number format", test.axis)
+		}
+	}
+	if got, _ := file.GetCellValue("Sheet1", "A2"); got != "2023-01-31 23:30:00" {
+		t.Errorf("unexpected formatted date %s", got)
+	}
+}
+
+func TestHyperlinkCell(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		label  string
+		want   interface{}
+	}{
+		{"", "label", nil},
+		{"eml/m1.eml", "eml/m1.eml", excelize.Cell{Formula: `HYPERLINK("eml/m1.eml","eml/m1.eml")`, Value: "eml/m1.eml"}},
+		{`a "quoted".pdf`, "a", excelize.Cell{Formula: `HYPERLINK("a ""quoted"".pdf","a")`, Value: "a"}},
+		{strings.Repeat("a", maxHyperlinkLength+1), "long", "long"},
+	} {
+		if got := hyperlinkCell(test.target, test.label); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.target, test.want, got)
+		}
+	}
+}
+
+func TestFileLinkCell(t *testing.T) {
+	for _, test := range []struct {
+		workbookDir string
+		filename    string
+		target      string
+	}{
+		{"", "eml/m1.eml", "eml/m1.eml"},
+		{"export", "export/eml/m1.eml", "eml/m1.eml"},
+		{"export", "attachments/a.pdf", "../attachments/a.pdf"},
+		{"/export", "attachments/a.pdf", "attachments/a.pdf"},
+	} {
+		opts := &SpreadsheetOptions{WorkbookDir: filepath.FromSlash(test.workbookDir)}
+		filename := filepath.FromSlash(test.filename)
+		want := excelize.Cell{Formula: `HYPERLINK("` + test.target + `","` + filename + `")`, Value: filename}
+		if got := fileLinkCell(filename, opts); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %s: expected %v, got %v", test.workbookDir, test.filename, want, got)
+		}
+	}
+	if got := fileLinkCell("", &SpreadsheetOptions{}); got != nil {
+		t.Errorf("expected no cell, got %v", got)
+	}
+}
+
+func TestLinkColumns(t *testing.T) {
+	msg := testColumnMessage()
+	msg.Eml = filepath.FromSlash("eml/m1.eml")
+	msg.Attachments = []*LocalAttachment{
+		nil,
+		{Filename: "a.pdf", OriginalFilename: "a.pdf"},
+		{OriginalFilename: "b.exe", Skipped: "filtered"},
+	}
+	for _, test := range []struct {
+		name string
+		opts *SpreadsheetOptions
+		want interface{}
+	}{
+		{"gmail_link", &SpreadsheetOptions{}, excelize.Cell{
+			Formula: `HYPERLINK("https://mail.google.com/mail/u/0/#all/m1","Open in Gmail")`, Value: "Open in Gmail"}},
+		{"gmail_link", &SpreadsheetOptions{Account: "jane@example.com"}, excelize.Cell{
+			Formula: `HYPERLINK("https://mail.google.com/mail/u/jane@example.com/#all/m1","Open in Gmail")`, Value: "Open in Gmail"}},
+		{"eml", &SpreadsheetOptions{}, excelize.Cell{
+			Formula: `HYPERLINK("eml/m1.eml","` + msg.Eml + `")`, Value: msg.Eml}},
+		{"attachment1", &SpreadsheetOptions{}, excelize.Cell{Formula: `HYPERLINK("a.pdf","a.pdf")`, Value: "a.pdf"}},
+		{"attachment2", &SpreadsheetOptions{}, "b.exe (skipped: filtered)"},
+		{"attachment3", &SpreadsheetOptions{}, nil},
+		{"attachment_list", &SpreadsheetOptions{}, "a.pdf,b.exe (skipped: filtered)"},
+	} {
+		if got := testColumnValue(t, test.name, msg, test.opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestLabelColumns(t *testing.T) {
+	opts := &SpreadsheetOptions{LabelNames: map[string]string{"INBOX": "INBOX", "UNREAD": "UNREAD", "Label_1": "Work"}}
+	for _, test := range []struct {
+		name     string
+		labelIds []string
+		want     interface{}
+	}{
+		{"labels", []string{"INBOX", "UNREAD", "Label_1", "Label_2"}, "INBOX, UNREAD, Work, Label_2"},
+		{"user_labels", []string{"INBOX", "UNREAD", "Label_1", "Label_2"}, "Work, Label_2"},
+		{"user_labels", []string{"INBOX"}, ""},
+		{"label_ids", []string{"INBOX", "Label_1"}, "INBOX, Label_1"},
+		{"unread", []string{"INBOX", "UNREAD"}, true},
+		{"unread", []string{"INBOX"}, false},
+		{"starred", []string{"STARRED"}, true},
+		{"important", nil, false},
+		{"spam", []string{"SPAM"}, true},
+		{"trash", []string{"INBOX"}, false},
+		{"category", []string{"INBOX", "CATEGORY_PROMOTIONS"}, "Promotions"},
+		{"category", []string{"CATEGORY_PERSONAL"}, "Primary"},
+		{"category", []string{"INBOX"}, nil},
+	} {
+		msg := testColumnMessage()
+		msg.LabelIds = test.labelIds
+		if got := testColumnValue(t, test.name, msg, opts); got != test.want {
+			t.Errorf("%s %v: expected %v, got %v", test.name, test.labelIds, test.want, got)
+		}
+	}
+}
+
+func TestStateColumns(t *testing.T) {
+	columns, _ := ParseColumns([]string{"labels", "user_labels", "label_ids", "unread", "starred",
+		"important", "spam", "trash", "category", "subject", "from", "date"})
+	for _, column := range columns {
+		// refreshed on the rows of messages appended again
+		want := column.Name != "subject" && column.Name != "from" && column.Name != "date"
+		if column.State != want {
+			t.Errorf("%s: expected state %v", column.Name, want)
+		}
+	}
+}
+
+func TestAddressColumns(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		from string
+		want interface{}
+	}{
+		{"sender_name", "Jane Doe <Jane@Example.com>", "Jane Doe"},
+		{"sender_email", "Jane Doe <Jane@Example.com>", "jane@example.com"},
+		{"sender_domain", "Jane Doe <Jane@Example.com>", "example.com"},
+		{"sender_name", "=?UTF-8?Q?Jos=C3=A9?= <jose@example.com>, b@example.com", "José"},
+		{"sender_email", "", nil},
+		{"recipient_count", "", 3},
+		{"recipients", "", `a@example.com, "Doe, John" <john@example.org>, c@example.com`},
+	} {
+		msg := testColumnMessage()
+		msg.Payload.Headers[0].Value = test.from
+		if got := testColumnValue(t, test.name, msg, &SpreadsheetOptions{}); got != test.want {
+			t.Errorf("%s %q: expected %v, got %v", test.name, test.from, test.want, got)
+		}
+	}
+}
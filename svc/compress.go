@@ -0,0 +1,135 @@
+package svc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats of the EML files.
+const (
+	EmlCompressNone = "none"
+	EmlCompressGzip = "gzip"
+	EmlCompressZstd = "zstd"
+)
+
+// EmlCompressor compresses EML files, named after the format extension.
+type EmlCompressor struct {
+	Format string
+	// Format specific, the default one when zero
+	Level int
+
+	zstd *zstd.Encoder
+}
+
+// Returns a compressor for the format, or nil when not compressing.
+func NewEmlCompressor(format string, level int) (*EmlCompressor, error) {
+	c := &EmlCompressor{Format: format, Level: level}
+	switch format {
+	case EmlCompressNone, "":
+		return nil, nil
+	case EmlCompressGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip levels range from 1 to %d", gzip.BestCompression)
+		}
+	case EmlCompressZstd:
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("zstd levels range from 1 to 22")
+		}
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		var err error
+		if c.zstd, err = zstd.NewWriter(nil, opts...); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", format)
+	}
+	return c, nil
+}
+
+// Returns the extension appended to the names of compressed files.
+func (c *EmlCompressor) Ext() string {
+	if c.Format == EmlCompressGzip {
+		return ".gz"
+	}
+	return ".zst"
+}
+
+func (c *EmlCompressor) Compress(data []byte) ([]byte, error) {
+	if c.zstd != nil {
+		return c.zstd.EncodeAll(data, make([]byte, 0, len(data)/4)), nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns whether a file is a compressed EML, named after the format
+// extension.
+func isCompressedEml(filename string) bool {
+	lower := strings.ToLower(filename)
+	return strings.HasSuffix(lower, ".eml.gz") || strings.HasSuffix(lower, ".eml.zst")
+}
+
+// Returns a reader of the decompressed content, as of the file extension.
+// Other files are read as they are.
+func decompressReader(filename string, r io.Reader) (io.ReadCloser, error) {
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".gz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(lower, ".zst"):
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// Opens an EML file, decompressing it transparently.
+func OpenEml(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompressReader(filename, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &emlReader{ReadCloser: r, file: f}, nil
+}
+
+// emlReader closes both the decompressor and the file.
+type emlReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *emlReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,361 @@
+package svc
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidecavestro/gmail-exporter/logger"
+	"github.com/ledongthuc/pdf"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Attachment types supported by text extraction.
+var ExtractTextTypes = []string{"pdf", "docx", "xlsx", "odt", "txt", "csv", "html"}
+
+// Size limit of the attachments to extract text from, when not specified for
+// their type.
+const DefaultExtractMaxSize = 20 * 1024 * 1024
+
+// Size limit of the entries unzipped from docx, odt and xlsx attachments,
+// guarding against zip bombs.
+const maxExtractEntrySize = 100 * 1024 * 1024
+
+// Parsers running at the same time. Parsers timed out keep their slot until
+// they complete, so that they cannot pile up.
+const maxExtractWorkers = 4
+
+var extractWorkers = make(chan struct{}, maxExtractWorkers)
+
+// TextExtractor extracts plain text from attachments, so that their content
+// can be searched.
+type TextExtractor struct {
+	// Types to extract text from, among ExtractTextTypes
+	Types map[string]bool
+	// Size limits by type, DefaultExtractMaxSize when missing
+	MaxSizes map[string]int64
+	Timeout  time.Duration
+	// Length of the excerpt kept for the spreadsheet
+	ExcerptLength int
+}
+
+// Returns the extraction type of an attachment, after its extension or its
+// MIME type, empty when not supported.
+func extractType(filename string, mimeType string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	switch ext {
+	case "htm":
+		return "html"
+	case "pdf", "docx", "xlsx", "odt", "txt", "csv", "html":
+		return ext
+	}
+	switch strings.ToLower(mimeType) {
+	case "application/pdf":
+		return "pdf"
+	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		return "docx"
+	case "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+		return "xlsx"
+	case "application/vnd.oasis.opendocument.text":
+		return "odt"
+	case "text/plain":
+		return "txt"
+	case "text/csv":
+		return "csv"
+	case "text/html":
+		return "html"
+	}
+	return ""
+}
+
+// Returns whether text is to be extracted from an attachment.
+func (e *TextExtractor) accepts(kind string, size int64) bool {
+	if kind == "" || !e.Types[kind] {
+		return false
+	}
+	max, ok := e.MaxSizes[kind]
+	if !ok {
+		max = DefaultExtractMaxSize
+	}
+	return max <= 0 || size <= max
+}
+
+// Returns the plain text of an attachment, failing on unsupported types,
+// malformed contents and timeouts. Parsers are not interruptible: on timeout
+// they are left completing in background, still holding a worker slot.
+func (e *TextExtractor) Extract(kind string, data []byte) (string, error) {
+	type result struct {
+		text string
+		err  error
+	}
+	var timeout <-chan time.Time
+	if e.Timeout > 0 {
+		timeout = time.After(e.Timeout)
+	}
+	select {
+	case extractWorkers <- struct{}{}:
+	case <-timeout:
+		return "", fmt.Errorf("%s text extraction timed out after %v, waiting for a worker", kind, e.Timeout)
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-extractWorkers }()
+		defer func() {
+			// parsers may panic on malformed contents
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("malformed %s: %v", kind, r)}
+			}
+		}()
+		text, err := extractText(kind, data)
+		done <- result{text, err}
+	}()
+	select {
+	case r := <-done:
+		return strings.ToValidUTF8(r.text, ""), r.err
+	case <-timeout:
+		return "", fmt.Errorf("%s text extraction timed out after %v", kind, e.Timeout)
+	}
+}
+
+func extractText(kind string, data []byte) (string, error) {
+	switch kind {
+	case "txt", "csv":
+		return string(data), nil
+	case "html":
+		return htmlText(data)
+	case "pdf":
+		return pdfText(data)
+	case "docx":
+		return zippedXmlText(data, "word/document.xml", docxBreaks)
+	case "odt":
+		return zippedXmlText(data, "content.xml", odtBreaks)
+	case "xlsx":
+		return xlsxText(data)
+	}
+	return "", fmt.Errorf("unsupported type %s", kind)
+}
+
+// Returns the text of an html document, without scripts and styles.
+func htmlText(data []byte) (string, error) {
+	var b strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(data))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return b.String(), nil
+			}
+			return b.String(), z.Err()
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Script, atom.Style:
+				skip++
+			case atom.P, atom.Div, atom.Br, atom.Tr, atom.Li, atom.H1, atom.H2, atom.H3:
+				b.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if a := atom.Lookup(name); (a == atom.Script || a == atom.Style) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+func pdfText(data []byte) (string, error) {
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	text, err := r.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(text)
+	return string(b), err
+}
+
+// Local names of the elements breaking lines or separating text, by document
+// format.
+var (
+	docxBreaks = map[string]string{"p": "\n", "br": "\n", "cr": "\n", "tab": "\t"}
+	odtBreaks  = map[string]string{"p": "\n", "h": "\n", "line-break": "\n", "tab": "\t", "s": " "}
+)
+
+// Returns the character data of an xml entry of a zipped document, i.e. the
+// body of docx and odt files.
+func zippedXmlText(data []byte, entry string, breaks map[string]string) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	var file *zip.File
+	for _, f := range z.File {
+		if f.Name == entry {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return "", fmt.Errorf("missing %s", entry)
+	}
+	if file.UncompressedSize64 > maxExtractEntrySize {
+		return "", fmt.Errorf("%s exceeds %d bytes", entry, maxExtractEntrySize)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var b strings.Builder
+	// the declared size could be forged
+	d := xml.NewDecoder(io.LimitReader(f, maxExtractEntrySize))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return b.String(), nil
+		}
+		if err != nil {
+			return b.String(), err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.StartElement:
+			if sep, ok := breaks[t.Name.Local]; ok && sep != "\n" {
+				b.WriteString(sep)
+			}
+		case xml.EndElement:
+			if sep, ok := breaks[t.Name.Local]; ok && sep == "\n" {
+				b.WriteString(sep)
+			}
+		}
+	}
+}
+
+// Returns the cells of every sheet, separated by tabs.
+func xlsxText(data []byte) (string, error) {
+	stored, err := storedZip(data, maxExtractEntrySize)
+	if err != nil {
+		return "", err
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(stored))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var b strings.Builder
+	for _, sheet := range f.GetSheetList() {
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return b.String(), err
+		}
+		b.WriteString(sheet + "\n")
+		for _, row := range rows {
+			b.WriteString(strings.Join(row, "\t") + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// Returns a copy of a zip archive with its entries stored, failing when they
+// exceed limit bytes unzipped. The declared sizes are checked first, while the
+// actual contents are read through a limited reader, as they could be forged.
+// Lets parsers unzipping by themselves (i.e. excelize) work within the limit.
+func storedZip(data []byte, limit int64) ([]byte, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var size uint64
+	for _, f := range z.File {
+		size += f.UncompressedSize64
+	}
+	if size > uint64(limit) {
+		return nil, fmt.Errorf("archive exceeds %d bytes unzipped", limit)
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	remaining := limit
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Store})
+		if err == nil {
+			var n int64
+			n, err = io.Copy(entry, io.LimitReader(r, remaining+1))
+			remaining -= n
+		}
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if remaining < 0 {
+			return nil, fmt.Errorf("archive exceeds %d bytes unzipped", limit)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Collapses the blank runs of the text, for spreadsheet excerpts.
+func excerpt(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if length > 0 && len(text) > length {
+		text = cutString(text, length) + "…"
+	}
+	return text
+}
+
+// Extracts the text of a saved attachment, keeping an excerpt and writing the
+// full text to a sidecar file next to it. Contents not at hand are read back
+// from the filesystem, when possible.
+func (e *TextExtractor) process(out Output, attachment *LocalAttachment, data []byte) {
+	kind := extractType(attachment.OriginalFilename, attachment.MimeType)
+	if !e.accepts(kind, attachment.Size) {
+		return
+	}
+	if data == nil {
+		if !isDirOutput(out) {
+			return
+		}
+		var err error
+		if data, err = os.ReadFile(attachment.Filename); err != nil {
+			return
+		}
+	}
+	text, err := e.Extract(kind, data)
+	if err != nil {
+		logger.Debugf("Unable to extract text from %s: %v", attachment.Filename, err)
+		return
+	}
+	attachment.TextExcerpt = excerpt(text, e.ExcerptLength)
+	if kind == "txt" || kind == "csv" {
+		// already plain text
+		return
+	}
+	sidecar := attachment.Filename + ".txt"
+	if err := out.WriteFile(sidecar, []byte(text), time.Time{}); err != nil {
+		logger.Debugf("Unable to save text of %s: %v", attachment.Filename, err)
+		return
+	}
+	attachment.TextFile = out.Path(sidecar)
+}
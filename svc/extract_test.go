@@ -0,0 +1,228 @@
+package svc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Returns a zip archive of the entries, deflated.
+func testZip(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testXlsx(t *testing.T) []byte {
+	t.Helper()
+	f := excelize.NewFile()
+	f.SetSheetRow("Sheet1", "A1", &[]interface{}{"name", "total"})
+	f.SetSheetRow("Sheet1", "A2", &[]interface{}{"rent", 1200})
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractType(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		mimeType string
+		want     string
+	}{
+		{"report.PDF", "", "pdf"},
+		{"page.htm", "", "html"},
+		{"notes", "text/plain", "txt"},
+		{"data.bin", "text/CSV", "csv"},
+		{"doc", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "docx"},
+		{"sheet.xlsx", "application/octet-stream", "xlsx"},
+		{"text.odt", "", "odt"},
+		{"image.png", "image/png", ""},
+		{"", "", ""},
+	} {
+		if got := extractType(test.filename, test.mimeType); got != test.want {
+			t.Errorf("%s %s: expected %q, got %q", test.filename, test.mimeType, test.want, got)
+		}
+	}
+}
+
+func TestExtractAccepts(t *testing.T) {
+	e := &TextExtractor{
+		Types:    map[string]bool{"pdf": true, "txt": true, "csv": true},
+		MaxSizes: map[string]int64{"txt": 10, "csv": 0},
+	}
+	for _, test := range []struct {
+		kind string
+		size int64
+		want bool
+	}{
+		{"pdf", DefaultExtractMaxSize, true},
+		{"pdf", DefaultExtractMaxSize + 1, false},
+		{"txt", 10, true},
+		{"txt", 11, false},
+		{"csv", 1 << 40, true},
+		{"docx", 1, false},
+		{"", 1, false},
+	} {
+		if got := e.accepts(test.kind, test.size); got != test.want {
+			t.Errorf("%s %d: expected %v, got %v", test.kind, test.size, test.want, got)
+		}
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	docx := testZip(t, map[string]string{"word/document.xml": `<w:document xmlns:w="w"><w:body>` +
+		`<w:p><w:r><w:t>first</w:t><w:tab/><w:t>cell</w:t></w:r></w:p><w:p><w:r><w:t>second</w:t></w:r></w:p>` +
+		`</w:body></w:document>`})
+	odt := testZip(t, map[string]string{"content.xml": `<office:document-content xmlns:office="o" xmlns:text="t">` +
+		`<text:h>title</text:h><text:p>one<text:s/>two</text:p></office:document-content>`})
+	for _, test := range []struct {
+		kind    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"txt", []byte("plain"), "plain", false},
+		{"html", []byte(`<p>a<script>x()</script><style>p{}</style></p><div>b</div>`), "\na\nb", false},
+		{"docx", docx, "first\tcell\nsecond\n", false},
+		{"odt", odt, "title\none two\n", false},
+		{"xlsx", testXlsx(t), "Sheet1\nname\ttotal\nrent\t1200\n", false},
+		{"docx", odt, "", true},
+		{"docx", []byte("not a zip"), "", true},
+		{"pdf", []byte("not a pdf"), "", true},
+		{"png", []byte("data"), "", true},
+	} {
+		e := &TextExtractor{Timeout: time.Minute}
+		got, err := e.Extract(test.kind, test.data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.kind, err)
+		}
+		if !test.wantErr && got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.kind, test.want, got)
+		}
+	}
+	if len(extractWorkers) != 0 {
+		t.Errorf("worker slots not released: %d", len(extractWorkers))
+	}
+}
+
+func TestExtractZipLimits(t *testing.T) {
+	// an entry declaring a size beyond the limit
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, err := w.CreateRaw(&zip.FileHeader{
+		Name:               "word/document.xml",
+		Method:             zip.Store,
+		CompressedSize64:   3,
+		UncompressedSize64: maxExtractEntrySize + 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Write([]byte("<a>"))
+	w.Close()
+	if _, err := zippedXmlText(buf.Bytes(), "word/document.xml", docxBreaks); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected the declared size rejected, got %v", err)
+	}
+
+	// entries larger once unzipped than declared
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(bytes.Repeat([]byte("a"), 1000))
+	fw.Close()
+	buf.Reset()
+	w = zip.NewWriter(&buf)
+	entry, err = w.CreateRaw(&zip.FileHeader{
+		Name:               "xl/workbook.xml",
+		Method:             zip.Deflate,
+		CompressedSize64:   uint64(deflated.Len()),
+		UncompressedSize64: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Write(deflated.Bytes())
+	w.Close()
+	if _, err := storedZip(buf.Bytes(), 100); err == nil {
+		t.Error("expected the actual size rejected")
+	}
+
+	stored, err := storedZip(testZip(t, map[string]string{"a.txt": "aaaa", "b.txt": "bbbb"}), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(stored), int64(len(stored)))
+	if err != nil || len(z.File) != 2 || z.File[0].Method != zip.Store {
+		t.Errorf("unexpected stored archive: %v", err)
+	}
+	if _, err := storedZip(testZip(t, map[string]string{"a.txt": "aaaa", "b.txt": "bbbbb"}), 8); err == nil {
+		t.Error("expected the total size rejected")
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		length int
+		want   string
+	}{
+		{"  a\n\tb  c ", 0, "a b c"},
+		{"abcdef", 3, "abc…"},
+		{"àèìòù", 4, "àè…"},
+		{"short", 10, "short"},
+	} {
+		if got := excerpt(test.text, test.length); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.text, test.want, got)
+		}
+	}
+}
+
+func TestExtractProcess(t *testing.T) {
+	dir := t.TempDir()
+	e := &TextExtractor{Types: map[string]bool{"html": true, "txt": true}, ExcerptLength: 5}
+	for _, test := range []struct {
+		filename string
+		content  string
+		excerpt  string
+		sidecar  bool
+	}{
+		{"page.html", "<p>hello world</p>", "hello…", true},
+		{"notes.txt", "plain text", "plain…", false},
+		{"image.png", "PNG", "", false},
+	} {
+		filename := filepath.Join(dir, test.filename)
+		if err := os.WriteFile(filename, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		attachment := &LocalAttachment{Filename: filename, OriginalFilename: test.filename, Size: int64(len(test.content))}
+		// read back from the filesystem
+		e.process(&DirOutput{}, attachment, nil)
+		if attachment.TextExcerpt != test.excerpt || (attachment.TextFile != "") != test.sidecar {
+			t.Errorf("%s: unexpected excerpt %q and sidecar %q", test.filename, attachment.TextExcerpt, attachment.TextFile)
+		}
+		if test.sidecar {
+			if data, err := os.ReadFile(filename + ".txt"); err != nil || !strings.Contains(string(data), "hello world") {
+				t.Errorf("%s: unexpected sidecar %q (%v)", test.filename, data, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package svc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Strategies naming attachments clashing with already saved ones.
+const (
+	// Append a counter, i.e. report (2).pdf
+	CollisionCounter = "counter"
+	// Prefix the gmail part id, i.e. 1.2_report.pdf
+	CollisionPartId = "part-id"
+	// Append a hash of the content, i.e. report-1a2b3c4d.pdf, so that the
+	// same content gets the same name
+	CollisionHash = "hash"
+)
+
+// Longest file name, in bytes, leaving room for collision suffixes.
+const maxFilenameLength = 200
+
+var unsafeFilenameChars = regexp.MustCompile(`[<>:"/\\|?*]`)
+
+var rfc2231Pattern = regexp.MustCompile(`^([A-Za-z0-9_-]+)'[A-Za-z0-9_-]*'(.*)$`)
+
+// Windows reserved device names, unusable as file names whatever the
+// extension.
+var reservedFilenames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+
+// Returns the file name declared for a part, decoding RFC 2231 and RFC 2047
+// encodings.
+func PartFilename(part *gmail.MessagePart) string {
+	name := part.Filename
+	for _, ph := range part.Headers {
+		if strings.EqualFold(ph.Name, "Content-Disposition") {
+			// decodes RFC 2231 parameters, i.e. filename*=UTF-8''%E2%82%AC.pdf
+			if _, params, err := mime.ParseMediaType(ph.Value); err == nil && params["filename"] != "" {
+				name = params["filename"]
+			}
+		}
+	}
+	if match := rfc2231Pattern.FindStringSubmatch(name); match != nil && strings.EqualFold(match[1], "utf-8") {
+		if decoded, err := url.PathUnescape(match[2]); err == nil {
+			name = decoded
+		}
+	}
+	return DecodeHeader(name)
+}
+
+// Returns a file name safe to be written on any filesystem: without
+// directories, control, formatting (i.e. bidi overrides) or reserved
+// characters, reserved names, and not exceeding the length limit.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	// blocks path traversal, keeping the last segment
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	// avoids hidden files and names Windows cannot handle
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+	// Windows reserves the names whatever the extensions, i.e. con.tar.gz
+	stem := name
+	if i := strings.Index(name, "."); i >= 0 {
+		stem = name[:i]
+	}
+	if reservedFilenames.MatchString(strings.TrimRight(stem, " ")) {
+		name = "_" + name
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if len(ext) > maxFilenameLength/4 {
+		ext = ""
+		base = name
+	}
+	if len(base)+len(ext) > maxFilenameLength {
+		base = cutString(base, maxFilenameLength-len(ext))
+	}
+	name = base + ext
+	if name == "" || name == ext {
+		name = "attachment" + ext
+	}
+	return name
+}
+
+// UniqueFilenames keeps track of the files saved during the export, to name
+// clashing ones following a collision strategy. Files saved by previous runs
+// are overwritten, so that exports can be repeated.
+type UniqueFilenames struct {
+	Strategy string
+	// content hashes of the used paths
+	used  map[string]string
+	mutex sync.Mutex
+}
+
+func NewUniqueFilenames(strategy string) *UniqueFilenames {
+	return &UniqueFilenames{Strategy: strategy, used: make(map[string]string)}
+}
+
+// Returns a path within dir for a file named name, not clashing with the
+// ones returned before.
+func (u *UniqueFilenames) Unique(dir string, name string, partId string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return u.UniqueHash(dir, name, partId, hex.EncodeToString(sum[:]))
+}
+
+// Same as Unique, for a content known by its hex SHA-256 digest.
+func (u *UniqueFilenames) UniqueHash(dir string, name string, partId string, hash string) string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := filepath.Join(dir, name)
+	if _, ok := u.used[candidate]; ok {
+		switch u.Strategy {
+		case CollisionHash:
+			// the same content gets the same name
+			if u.used[candidate] != hash {
+				candidate = filepath.Join(dir, fmt.Sprintf("%s-%s%s", base, hash[:8], ext))
+			}
+			if u.used[candidate] == hash {
+				return candidate
+			}
+		case CollisionPartId:
+			if partId != "" {
+				candidate = filepath.Join(dir, fmt.Sprintf("%s_%s", partId, name))
+			}
+		}
+	}
+	for n := 2; u.used[candidate] != ""; n++ {
+		candidate = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+	u.used[candidate] = hash
+	return candidate
+}
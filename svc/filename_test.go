@@ -0,0 +1,100 @@
+package svc
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\win.ini`, "win.ini"},
+		{"a<b>c:d\"e|f?g*h.txt", "a_b_c_d_e_f_g_h.txt"},
+		{"line\r\nbreak\x00.txt", "linebreak.txt"},
+		{".hidden", "hidden"},
+		{"trailing. . ", "trailing"},
+		{"CON.txt", "_CON.txt"},
+		{"lpt1", "_lpt1"},
+		{"con.tar.gz", "_con.tar.gz"},
+		{"nul.txt.zip", "_nul.txt.zip"},
+		{"AUX .txt", "_AUX .txt"},
+		{"console.txt", "console.txt"},
+		{"invoice\u202Efdp.exe", "invoicefdp.exe"},
+		{"zero\u200Bwidth.txt", "zerowidth.txt"},
+		{"", "attachment"},
+		{"...", "attachment"},
+		{"/", "attachment"},
+		{".pdf", "pdf"},
+		{"€ fattura.pdf", "€ fattura.pdf"},
+	} {
+		if got := SanitizeFilename(test.name); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	long := strings.Repeat("à", 150) + ".pdf"
+	got := SanitizeFilename(long)
+	if len(got) > maxFilenameLength || !strings.HasSuffix(got, ".pdf") {
+		t.Errorf("expected at most %d bytes keeping the extension, got %d: %q", maxFilenameLength, len(got), got)
+	}
+	if !strings.HasPrefix(got, "à") || strings.ContainsRune(got, '�') {
+		t.Errorf("multi-byte chars cut: %q", got)
+	}
+	// long extensions are not kept apart
+	ext := "." + strings.Repeat("x", 300)
+	if got := SanitizeFilename("name" + ext); len(got) > maxFilenameLength || !strings.HasPrefix(got, "name.") {
+		t.Errorf("unexpected name for long extension: %q", got)
+	}
+}
+
+func TestPartFilename(t *testing.T) {
+	for _, test := range []struct {
+		filename    string
+		disposition string
+		want        string
+	}{
+		{"plain.pdf", "", "plain.pdf"},
+		{"=?UTF-8?B?w6guZG9jeA==?=", "", "è.docx"},
+		{"=?iso-8859-1?Q?caf=E9.txt?=", "", "café.txt"},
+		{"UTF-8''%E2%82%AC.pdf", "", "€.pdf"},
+		{"ignored.pdf", "attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf", "résumé.pdf"},
+	} {
+		part := &gmail.MessagePart{Filename: test.filename}
+		if test.disposition != "" {
+			part.Headers = []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: test.disposition}}
+		}
+		if got := PartFilename(part); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.filename, test.want, got)
+		}
+	}
+}
+
+func TestUniqueFilenames(t *testing.T) {
+	dir := "att"
+	for _, test := range []struct {
+		strategy string
+		// names of report.pdf saved with contents a, b, a
+		want []string
+	}{
+		{CollisionCounter, []string{"report.pdf", "report (2).pdf", "report (3).pdf"}},
+		{CollisionPartId, []string{"report.pdf", "1_report.pdf", "2_report.pdf"}},
+		{CollisionHash, []string{"report.pdf", "report-3e23e816.pdf", "report.pdf"}},
+	} {
+		names := NewUniqueFilenames(test.strategy)
+		for i, content := range []string{"a", "b", "a"} {
+			got := names.Unique(dir, "report.pdf", []string{"0", "1", "2"}[i], []byte(content))
+			if want := filepath.Join(dir, test.want[i]); got != want {
+				t.Errorf("%s #%d: expected %s, got %s", test.strategy, i, want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package svc
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// AttachmentFilter selects the attachments to be saved, by MIME type,
+// extension, file name and size. Empty criteria match any attachment.
+type AttachmentFilter struct {
+	// MIME types, supporting wildcards, i.e. image/*
+	IncludeTypes []string
+	ExcludeTypes []string
+	// Extensions, with or without the leading dot
+	IncludeExts    []string
+	ExcludeExts    []string
+	IncludePattern *regexp.Regexp
+	ExcludePattern *regexp.Regexp
+	MinSize        int64
+	// Ignored when not positive
+	MaxSize int64
+}
+
+func matchesType(patterns []string, mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesExt(exts []string, filename string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	for _, e := range exts {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns why an attachment is skipped, or an empty string when it is to be
+// saved.
+func (f *AttachmentFilter) Check(filename string, mimeType string, size int64) string {
+	if f == nil {
+		return ""
+	}
+	switch {
+	case len(f.IncludeTypes) > 0 && !matchesType(f.IncludeTypes, mimeType):
+		return fmt.Sprintf("type %s not included", mimeType)
+	case matchesType(f.ExcludeTypes, mimeType):
+		return fmt.Sprintf("type %s excluded", mimeType)
+	case len(f.IncludeExts) > 0 && !matchesExt(f.IncludeExts, filename):
+		return "extension not included"
+	case matchesExt(f.ExcludeExts, filename):
+		return "extension excluded"
+	case f.IncludePattern != nil && !f.IncludePattern.MatchString(filename):
+		return "name not matching"
+	case f.ExcludePattern != nil && f.ExcludePattern.MatchString(filename):
+		return "name excluded"
+	case size < f.MinSize:
+		return fmt.Sprintf("smaller than %s", HumanBytes(f.MinSize))
+	case f.MaxSize > 0 && size > f.MaxSize:
+		return fmt.Sprintf("bigger than %s", HumanBytes(f.MaxSize))
+	}
+	return ""
+}
+
+// Returns the attachments actually saved, leaving out the skipped ones.
+func SavedAttachments(attachments []*LocalAttachment) []*LocalAttachment {
+	ret := make([]*LocalAttachment, 0, len(attachments))
+	for _, attachment := range attachments {
+		if attachment != nil && attachment.Skipped == "" {
+			ret = append(ret, attachment)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package svc
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestAttachmentFilterCheck(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		filter   *AttachmentFilter
+		filename string
+		mimeType string
+		size     int64
+		want     string
+	}{
+		{"no filter", nil, "a.exe", "application/x-msdownload", 1 << 40, ""},
+		{"empty filter", &AttachmentFilter{}, "a.exe", "application/x-msdownload", 1 << 40, ""},
+		{"included type", &AttachmentFilter{IncludeTypes: []string{"image/*", "application/pdf"}}, "a.png", "IMAGE/PNG", 1, ""},
+		{"not included type", &AttachmentFilter{IncludeTypes: []string{"image/*"}}, "a.pdf", "application/pdf", 1, "type application/pdf not included"},
+		{"excluded type", &AttachmentFilter{ExcludeTypes: []string{" video/* "}}, "a.mp4", "video/mp4", 1, "type video/mp4 excluded"},
+		{"included ext", &AttachmentFilter{IncludeExts: []string{".PDF", "docx"}}, "a.pdf", "", 1, ""},
+		{"not included ext", &AttachmentFilter{IncludeExts: []string{"pdf"}}, "a.pdf.exe", "", 1, "extension not included"},
+		{"excluded ext", &AttachmentFilter{ExcludeExts: []string{"exe"}}, "A.EXE", "", 1, "extension excluded"},
+		{"no ext", &AttachmentFilter{IncludeExts: []string{"pdf"}}, "README", "", 1, "extension not included"},
+		{"included name", &AttachmentFilter{IncludePattern: regexp.MustCompile(`^invoice`)}, "invoice-1.pdf", "", 1, ""},
+		{"not included name", &AttachmentFilter{IncludePattern: regexp.MustCompile(`^invoice`)}, "logo.png", "", 1, "name not matching"},
+		{"excluded name", &AttachmentFilter{ExcludePattern: regexp.MustCompile(`(?i)^image\d+`)}, "Image001.png", "", 1, "name excluded"},
+		{"min size", &AttachmentFilter{MinSize: 1024}, "a.png", "", 1023, "smaller than 1.0 KB"},
+		{"max size", &AttachmentFilter{MaxSize: 1024}, "a.png", "", 1025, "bigger than 1.0 KB"},
+		{"within sizes", &AttachmentFilter{MinSize: 1024, MaxSize: 1024}, "a.png", "", 1024, ""},
+		// types are checked first
+		{"several criteria", &AttachmentFilter{ExcludeTypes: []string{"image/*"}, MaxSize: 1}, "a.png", "image/png", 2, "type image/png excluded"},
+	} {
+		if got := test.filter.Check(test.filename, test.mimeType, test.size); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSavedAttachments(t *testing.T) {
+	saved := &LocalAttachment{Filename: "a.pdf"}
+	got := SavedAttachments([]*LocalAttachment{nil, saved, {OriginalFilename: "b.exe", Skipped: "extension excluded"}})
+	if !reflect.DeepEqual(got, []*LocalAttachment{saved}) {
+		t.Errorf("expected just the saved attachment, got %v", got)
+	}
+}
+
+func TestSaveFilteredAttachments(t *testing.T) {
+	dir := t.TempDir()
+	opts := &AttachmentOptions{
+		Dir:    dir,
+		Names:  NewUniqueFilenames(CollisionCounter),
+		Filter: &AttachmentFilter{ExcludePattern: regexp.MustCompile(`^b`)},
+	}
+	msg := &gmail.Message{Id: "m1", Payload: testNestedPayload()}
+	attachments, err := SaveAttachments(nil, nil, &DirOutput{}, opts, "me", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 3 {
+		t.Fatalf("expected skipped attachments listed too, got %d", len(attachments))
+	}
+	skipped := attachments[1]
+	if skipped.OriginalFilename != "b.pdf" || skipped.Skipped != "name excluded" || skipped.Filename != "" || skipped.Size != 6 {
+		t.Errorf("unexpected skipped attachment %+v", skipped)
+	}
+	if len(SavedAttachments(attachments)) != 2 {
+		t.Errorf("expected 2 saved attachments")
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for _, test := range []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"500k", 500 * 1024, false},
+		{" 20 MB ", 20 << 20, false},
+		{"1.5GiB", 3 << 29, false},
+		{"2t", 2 << 40, false},
+		{"1KB", 1024, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"ten", 0, true},
+		{"10X", 0, true},
+		{"10 k b", 0, true},
+		{"NaN", 0, true},
+		{"inf", 0, true},
+	} {
+		got, err := ParseBytes(test.input)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%q: expected %d, got %d (%v)", test.input, test.want, got, err)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	for _, test := range []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KB"},
+		{20 << 20, "20.0 MB"},
+		{3 << 29, "1.5 GB"},
+	} {
+		if got := HumanBytes(test.size); got != test.want {
+			t.Errorf("%d: expected %s, got %s", test.size, test.want, got)
+		}
+		// human sizes can be parsed back
+		if parsed, err := ParseBytes(HumanBytes(test.size)); err != nil || parsed != test.size {
+			t.Errorf("%d: parsed back as %d (%v)", test.size, parsed, err)
+		}
+	}
+}
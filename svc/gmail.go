@@ -2,9 +2,11 @@ package svc
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/base64"
-	"io/ioutil"
+	"encoding/hex"
+	"mime"
 	"os"
 	"path/filepath"
 	"strings"
@@ -21,6 +23,29 @@ import (
 
 type LocalAttachment struct {
 	Filename string
+	// File name as declared by the message, decoded
+	OriginalFilename string
+	// Gmail part id, zero based: i.e. 0.1 for the second part of the first one
+	PartId string
+	// Gmail attachment id, empty for the parts embedded in the message
+	AttachmentId string
+	MimeType     string
+	Size         int64
+	// MIME types of the enclosing parts, outermost first
+	NestingPath string
+	Sha256      string
+	// Why the attachment has not been saved, empty when saved
+	Skipped string
+	// Whether the part is embedded in the body, rather than attached
+	Inline bool
+	// Content-ID referenced by the html body through cid: urls
+	ContentId string
+	// Excerpt of the text extracted from the attachment, if any
+	TextExcerpt string
+	// Sidecar file with the whole extracted text
+	TextFile string
+	// content of inline parts, kept for embedding them
+	data []byte
 }
 
 //go:embed credentials.json
@@ -38,101 +63,347 @@ func GetGmailSrv(TokenFile string, BatchMode bool, NoBrowser bool, NoTokenSave b
 	return gmail.NewService(ctx, option.WithHTTPClient(client))
 }
 
-func SaveMessageFile(srv *gmail.Service, MessagesDir string, MessagesSeed *[]int32, user string, msgId string) (string, error) {
+// Retrieves the RFC 2822 source of a message.
+func GetRawMessage(srv *gmail.Service, user string, msgId string) (*gmail.Message, []byte, error) {
 	message, err := srv.Users.Messages.Get(user, msgId).Format("RAW").Do()
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
 	decodedData, err := base64.URLEncoding.DecodeString(message.Raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, decodedData, nil
+}
 
+// Saves the EML file of a message, named after the path template when not
+// nil, otherwise within the seed subfolders. Compressed files get the
+// extension of the format, i.e. .eml.gz
+func SaveMessageFile(srv *gmail.Service, out Output, MessagesDir string, MessagesSeed *[]int32, PathTemplate *PathTemplate, Compressor *EmlCompressor, user string, msg *gmail.Message) (string, error) {
+	message, decodedData, err := rawMessage(srv, user, msg)
 	if err != nil {
 		return "", err
 	}
-	// base64.URLEncoding(decodedData, decodedData)
 
-	paths := []string{MessagesDir}
-	var last int32
-	last = 0
-	for _, p := range *MessagesSeed {
-		paths = append(paths, message.Id[last:last+p])
-		last = p
+	filename := filepath.Join(MessagesDir, seedPath(MessagesSeed, message.Id), message.Id+".eml")
+	if PathTemplate != nil {
+		path, err := PathTemplate.Path(msg)
+		if err != nil {
+			return "", err
+		}
+		filename = filepath.Join(MessagesDir, path+".eml")
 	}
-
-	dirPath := filepath.Join(paths...)
-	err = os.MkdirAll(dirPath, os.ModePerm)
+	err = out.MkdirAll(filepath.Dir(filename))
 	if err != nil {
 		logger.Fatal("Unable to prepare messages dir: ", zap.Error(err))
 	}
-	filename := filepath.Join(dirPath, message.Id+".eml")
+	if Compressor != nil {
+		if decodedData, err = Compressor.Compress(decodedData); err != nil {
+			return "", err
+		}
+		filename += Compressor.Ext()
+	}
 
-	if err = ioutil.WriteFile(filename, decodedData, 0644); err != nil {
+	if err = out.WriteFile(filename, decodedData, time.UnixMilli(message.InternalDate)); err != nil {
 		return "", err
 	} else {
-		return filename, err
+		return out.Path(filename), err
 	}
 
 }
 
-func SaveAttachments(srv *gmail.Service, rateLimiter ratelimit.Limiter, AttachmentsDir string, AttachmentsSeed *[]int32, user string, message *gmail.Message) ([]*LocalAttachment, error) {
+// Visits the parts of the whole tree, along with the MIME types of their
+// enclosing parts.
+func walkParts(part *gmail.MessagePart, path []string, visit func(part *gmail.MessagePart, path []string)) {
+	if part == nil {
+		return
+	}
+	visit(part, path)
+	path = append(path[:len(path):len(path)], part.MimeType)
+	for _, child := range part.Parts {
+		walkParts(child, path, visit)
+	}
+}
+
+// Returns the value of the first header of a part matching name.
+func partHeader(part *gmail.MessagePart, name string) string {
+	for _, ph := range part.Headers {
+		if strings.EqualFold(ph.Name, name) {
+			return ph.Value
+		}
+	}
+	return ""
+}
+
+// Returns the Gmail attachment id of a part, if any.
+func partAttachmentId(part *gmail.MessagePart) string {
+	if part.Body == nil {
+		return ""
+	}
+	return part.Body.AttachmentId
+}
+
+// Returns the Content-ID of a part, without the angle brackets.
+func partContentId(part *gmail.MessagePart) string {
+	return strings.Trim(strings.TrimSpace(partHeader(part, "Content-ID")), "<>")
+}
+
+// Returns the disposition type of a part, i.e. attachment or inline, empty
+// when not declared.
+func partDisposition(part *gmail.MessagePart) string {
+	value := partHeader(part, "Content-Disposition")
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+}
+
+// Returns whether a part is an attachment, rather than a body or an inline
+// part. Named parts without disposition are attachments, unless referenced
+// by the body through their Content-ID.
+func isAttachment(part *gmail.MessagePart) bool {
+	if part.Filename == "" {
+		return false
+	}
+	switch partDisposition(part) {
+	case "inline":
+		return false
+	case "":
+		return partContentId(part) == ""
+	}
+	return true
+}
+
+// Returns whether a part is embedded in the body, i.e. an image referenced by
+// the html body.
+func isInline(part *gmail.MessagePart) bool {
+	if len(part.Parts) > 0 || strings.HasPrefix(part.MimeType, "multipart/") || isAttachment(part) {
+		return false
+	}
+	if part.Filename == "" {
+		// text bodies are not parts to be saved
+		return partContentId(part) != "" && part.MimeType != "text/plain" && part.MimeType != "text/html"
+	}
+	return true
+}
+
+// Common extensions of inline parts, preferred over the system MIME table.
+var inlineExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"image/bmp":     ".bmp",
+	"text/css":      ".css",
+}
+
+// Returns a file name for inline parts declaring none, after the part id and
+// the MIME type.
+func inlineFilename(part *gmail.MessagePart) string {
+	ext, ok := inlineExtensions[strings.ToLower(part.MimeType)]
+	if !ok {
+		if exts, _ := mime.ExtensionsByType(part.MimeType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return "inline-" + part.PartId + ext
+}
+
+// Returns the decoded content of a part, fetching it when not embedded
+// within the message.
+func getPartData(srv *gmail.Service, rateLimiter ratelimit.Limiter, user string, msgId string, part *gmail.MessagePart) ([]byte, error) {
+	if part.Body == nil {
+		return nil, nil
+	}
+	data := part.Body.Data
+	if data == "" && part.Body.AttachmentId != "" {
+		if rateLimiter != nil {
+			rateLimiter.Take()
+		}
+		attach, err := srv.Users.Messages.Attachments.Get(user, msgId, part.Body.AttachmentId).Do()
+		if err != nil {
+			return nil, err
+		}
+		data = attach.Data
+	}
+	return base64.URLEncoding.DecodeString(data)
+}
+
+// AttachmentOptions tunes how attachments are saved.
+type AttachmentOptions struct {
+	Dir  string
+	Seed *[]int32
+	// Names the folder of every message, rather than the seed, when not nil
+	Template *PathTemplate
+	// Names files clashing with the already saved ones
+	Names *UniqueFilenames
+	// Saves attachments by content when not nil
+	Store *ContentStore
+	// Skips the attachments not matching, when not nil
+	Filter *AttachmentFilter
+	// Also saves the parts embedded in the body, i.e. inline images
+	Inline bool
+	// Extracts the text of the saved attachments, when not nil
+	Extractor *TextExtractor
+}
+
+func SaveAttachments(srv *gmail.Service, rateLimiter ratelimit.Limiter, out Output, opts *AttachmentOptions, user string, message *gmail.Message) ([]*LocalAttachment, error) {
 
 	var ret []*LocalAttachment
-	if len(message.Payload.Parts) > 0 {
-
-		paths := []string{AttachmentsDir}
-		var last int32
-		last = 0
-		for _, p := range *AttachmentsSeed {
-			paths = append(paths, message.Id[last:last+p])
-			last = p
-		}
-		for _, p := range message.Payload.Parts {
-			// fmt.Printf("Filename: %s\n", p.Filename)
-			// fmt.Printf("Attachment ID: %s\n", p.Body.AttachmentId)
-
-			for attachmentId := p.Body.AttachmentId; attachmentId != ""; {
-				if rateLimiter != nil {
-					rateLimiter.Take()
-				}
-				attach, err := srv.Users.Messages.Attachments.Get(user, message.Id, attachmentId).Do()
-				if err != nil {
-					logger.Fatalf("Unable to retrieve attachment: %v", err)
-				}
-				attachmentId = attach.AttachmentId
-				if attachmentId != "" {
-					continue
-				}
-				if attach.Data == "" {
-					break
-				}
-				decoded, _ := base64.URLEncoding.DecodeString(attach.Data)
-
-				// p.Filename = mailReceivedDate + "_" + p.Filename
-				if p.Filename != "" {
-					for _, ph := range p.Headers {
-						if ph.Name == "Content-Disposition" {
-							if !strings.HasPrefix(ph.Value, "inline;") {
-								dirPath := filepath.Join(paths...)
-								err := os.MkdirAll(dirPath, os.ModePerm)
-								if err != nil {
-									logger.Fatal("Unable to prepare attachments dir: ", zap.Error(err))
-								}
-								filename := filepath.Join(dirPath, p.Filename)
-								err = ioutil.WriteFile(filename, decoded, 0644)
-								if err != nil {
-									logger.Fatal("Unable to save attachment: ", zap.Error(err))
-								}
-								ret = append(ret, &LocalAttachment{Filename: filename})
-							}
-						}
-					}
-				}
-			}
+
+	dirPath := filepath.Join(opts.Dir, seedPath(opts.Seed, message.Id))
+	if opts.Template != nil {
+		path, err := opts.Template.Path(message)
+		if err != nil {
+			return nil, err
 		}
+		dirPath = filepath.Join(opts.Dir, path)
 	}
+	walkParts(message.Payload, nil, func(p *gmail.MessagePart, nesting []string) {
+		inline := opts.Inline && isInline(p)
+		if !inline && !isAttachment(p) {
+			return
+		}
+		original := PartFilename(p)
+		if original == "" {
+			original = inlineFilename(p)
+		}
+		var size int64
+		if p.Body != nil {
+			size = p.Body.Size
+		}
+		if reason := opts.Filter.Check(original, p.MimeType, size); reason != "" {
+			ret = append(ret, &LocalAttachment{
+				OriginalFilename: original,
+				PartId:           p.PartId,
+				AttachmentId:     partAttachmentId(p),
+				MimeType:         p.MimeType,
+				Size:             size,
+				NestingPath:      strings.Join(nesting, " > "),
+				Skipped:          reason,
+				Inline:           inline,
+				ContentId:        partContentId(p),
+			})
+			return
+		}
+		if opts.Store != nil {
+			attachment, err := storeAttachment(srv, rateLimiter, out, opts, user, message.Id, dirPath, p, original, inline)
+			if err != nil {
+				logger.Fatal("Unable to save attachment: ", zap.Error(err))
+			}
+			if attachment != nil {
+				attachment.NestingPath = strings.Join(nesting, " > ")
+				ret = append(ret, attachment)
+			}
+			return
+		}
+		decoded, err := getPartData(srv, rateLimiter, user, message.Id, p)
+		if err != nil {
+			logger.Fatalf("Unable to retrieve attachment: %v", err)
+		}
+		if len(decoded) == 0 {
+			return
+		}
+
+		err = out.MkdirAll(dirPath)
+		if err != nil {
+			logger.Fatal("Unable to prepare attachments dir: ", zap.Error(err))
+		}
+		filename := opts.Names.Unique(dirPath, SanitizeFilename(original), p.PartId, decoded)
+		err = out.WriteFile(filename, decoded, time.Time{})
+		if err != nil {
+			logger.Fatal("Unable to save attachment: ", zap.Error(err))
+		}
+		sum := sha256.Sum256(decoded)
+		attachment := &LocalAttachment{
+			Filename:         out.Path(filename),
+			OriginalFilename: original,
+			PartId:           p.PartId,
+			AttachmentId:     partAttachmentId(p),
+			MimeType:         p.MimeType,
+			Size:             int64(len(decoded)),
+			NestingPath:      strings.Join(nesting, " > "),
+			Sha256:           hex.EncodeToString(sum[:]),
+			Inline:           inline,
+			ContentId:        partContentId(p),
+		}
+		if inline {
+			attachment.data = decoded
+		}
+		if opts.Extractor != nil {
+			opts.Extractor.process(out, attachment, decoded)
+		}
+		ret = append(ret, attachment)
+	})
 	return ret, nil
 }
 
+// Saves an attachment into the content store, reusing earlier downloads and
+// linking it from the message folder when requested. Text is extracted once
+// per stored object.
+func storeAttachment(srv *gmail.Service, rateLimiter ratelimit.Limiter, out Output, opts *AttachmentOptions, user string, msgId string, dirPath string, p *gmail.MessagePart, original string, inline bool) (*LocalAttachment, error) {
+	store := opts.Store
+	obj := store.lookup(p, original)
+	var decoded []byte
+	if obj == nil {
+		var err error
+		if decoded, err = getPartData(srv, rateLimiter, user, msgId, p); err != nil {
+			return nil, err
+		}
+		if len(decoded) == 0 {
+			return nil, nil
+		}
+		if obj, err = store.put(out, p, original, decoded); err != nil {
+			return nil, err
+		}
+	}
+	filename := obj.path
+	if store.Link != StoreLinkNone {
+		if err := out.MkdirAll(dirPath); err != nil {
+			return nil, err
+		}
+		filename = opts.Names.UniqueHash(dirPath, SanitizeFilename(original), p.PartId, obj.hash)
+		if err := store.link(obj, filename); err != nil {
+			return nil, err
+		}
+	}
+	attachment := &LocalAttachment{
+		Filename:         out.Path(filename),
+		OriginalFilename: original,
+		PartId:           p.PartId,
+		AttachmentId:     partAttachmentId(p),
+		MimeType:         p.MimeType,
+		Size:             obj.size,
+		Sha256:           obj.hash,
+		Inline:           inline,
+		ContentId:        partContentId(p),
+	}
+	if inline {
+		data, err := store.inlineData(obj, func() ([]byte, error) {
+			if decoded != nil {
+				return decoded, nil
+			}
+			return getPartData(srv, rateLimiter, user, msgId, p)
+		})
+		if err != nil {
+			return nil, err
+		}
+		attachment.data = data
+	}
+	if opts.Extractor != nil {
+		store.extractText(out, opts.Extractor, obj, attachment, decoded)
+	}
+	return attachment, nil
+}
+
+// Returns the email address of the account.
+func GetAccountEmail(srv *gmail.Service, user string) (string, error) {
+	profile, err := srv.Users.GetProfile(user).Do()
+	if err != nil {
+		return "", err
+	}
+	return profile.EmailAddress, nil
+}
+
 func ListLabels(srv *gmail.Service, user string) ([]*gmail.Label, error) {
 	if labels, err := srv.Users.Labels.List(user).Do(); err != nil {
 		return nil, err
@@ -163,7 +434,18 @@ func GetLabelsByIdOrName(srv *gmail.Service, user string, refs ...string) ([]*gm
 	}
 }
 
-func GetMessages(srv *gmail.Service, messagesLimit int, pui *ui.ProgressUI, user string, pageSize int64, pageLimit int64, labelRefs ...string) (chan *gmail.Message, int64) {
+// Returns the messages carrying all the labels, fetched as of the plan.
+func GetMessages(srv *gmail.Service, rateLimiter ratelimit.Limiter, pui *ui.ProgressUI, user string, pageSize int64, pageLimit int64, plan string, labelRefs ...string) (chan *gmail.Message, int64) {
+	return getMessages(srv, rateLimiter, pui, user, pageSize, pageLimit, plan, false, labelRefs...)
+}
+
+// Returns the messages carrying any of the labels, rather than all of them.
+// Messages carrying several labels are returned once.
+func GetAnyLabelMessages(srv *gmail.Service, rateLimiter ratelimit.Limiter, pui *ui.ProgressUI, user string, pageSize int64, pageLimit int64, plan string, labelRefs ...string) (chan *gmail.Message, int64) {
+	return getMessages(srv, rateLimiter, pui, user, pageSize, pageLimit, plan, true, labelRefs...)
+}
+
+func getMessages(srv *gmail.Service, rateLimiter ratelimit.Limiter, pui *ui.ProgressUI, user string, pageSize int64, pageLimit int64, plan string, anyLabel bool, labelRefs ...string) (chan *gmail.Message, int64) {
 	ret := make(chan *gmail.Message, pageSize)
 
 	var total int64 = 0
@@ -184,59 +466,86 @@ func GetMessages(srv *gmail.Service, messagesLimit int, pui *ui.ProgressUI, user
 	}
 
 	go func(ret chan *gmail.Message, srv *gmail.Service, user string, pageSize int64, pageLimit int64, labelIds ...string) {
-		var pageNum int64 = 0
 		defer close(ret)
-		caller := func() *gmail.UsersMessagesListCall {
-			logger.Debugf("Getting messages for page %d", pageNum)
-			return srv.Users.Messages.List(user).MaxResults(pageSize).LabelIds(labelIds...)
+
+		if !anyLabel {
+			fetchMessages(ret, srv, rateLimiter, pui, user, pageSize, pageLimit, plan, nil, labelIds...)
+			return
+		}
+		seen := make(map[string]bool)
+		for _, labelId := range labelIds {
+			fetchMessages(ret, srv, rateLimiter, pui, user, pageSize, pageLimit, plan, seen, labelId)
 		}
+	}(ret, srv, user, pageSize, pageLimit, labelIds...)
+
+	return ret, total
+}
 
-		limitWindow := ratelimit.Per(1 * time.Second)
-		var rateLimiter ratelimit.Limiter
-		if messagesLimit != 0 {
-			rateLimiter = ratelimit.New(messagesLimit, limitWindow)
+// Fetches the messages carrying all the labels, skipping the seen ones when
+// not nil. Raw messages are parsed locally.
+// Fetches a message according to the plan: structured, or as raw source
+// parsed locally.
+func fetchMessage(srv *gmail.Service, rateLimiter ratelimit.Limiter, user string, id string, plan string) *gmail.Message {
+	format := "full"
+	if plan == FetchRaw {
+		format = "RAW"
+	}
+	if rateLimiter != nil {
+		rateLimiter.Take()
+	}
+	msg, err := srv.Users.Messages.Get(user, id).Format(format).Do()
+	if err != nil {
+		logger.Fatalf("Unable to retrieve %s message: %v", id, err)
+	}
+	if plan == FetchRaw {
+		if err := ParseRawMessage(msg); err != nil {
+			logger.Fatalf("Unable to parse %s message: %v", id, err)
 		}
+	}
+	return msg
+}
 
-		msgs, err := caller().Do()
+func fetchMessages(ret chan *gmail.Message, srv *gmail.Service, rateLimiter ratelimit.Limiter, pui *ui.ProgressUI, user string, pageSize int64, pageLimit int64, plan string, seen map[string]bool, labelIds ...string) {
+	var pageNum int64 = 0
+	caller := func() *gmail.UsersMessagesListCall {
+		logger.Debugf("Getting messages for page %d", pageNum)
+		return srv.Users.Messages.List(user).MaxResults(pageSize).LabelIds(labelIds...)
+	}
 
-		for {
-			if err != nil {
-				logger.Fatalf("Unable to retrieve '%s' messages: %v", labelIds, err)
-				return
-			}
-			msgTotal := len(msgs.Messages)
-			if msgTotal == 0 {
-				logger.Debugf("No messages found.")
-				return
-			}
+	msgs, err := caller().Do()
 
-			pui.GmailNewPage(int64(msgTotal), pageNum)
-			// pui.GmailPageTotal(int64(pageTotal))
-			for _, m := range msgs.Messages {
-				if rateLimiter != nil {
-					rateLimiter.Take()
-				}
-				pui.GmailIncrement()
+	for {
+		if err != nil {
+			logger.Fatalf("Unable to retrieve '%s' messages: %v", labelIds, err)
+			return
+		}
+		msgTotal := len(msgs.Messages)
+		if msgTotal == 0 {
+			logger.Debugf("No messages found.")
+			return
+		}
 
-				msg, err := srv.Users.Messages.Get(user, m.Id).Format("full").Do()
-				if err != nil {
-					logger.Fatalf("Unable to retrieve %s message: %v", m.Id, err)
-					return
+		pui.GmailNewPage(int64(msgTotal), pageNum)
+		// pui.GmailPageTotal(int64(pageTotal))
+		for _, m := range msgs.Messages {
+			pui.GmailIncrement()
+			if seen != nil {
+				if seen[m.Id] {
+					continue
 				}
-				ret <- msg
-			}
-			if msgs.NextPageToken == "" {
-				return
+				seen[m.Id] = true
 			}
-
-			pageNum++
-			if pageLimit > 0 && pageNum >= pageLimit {
-				logger.Debugf("Limit of '%d' message pages reached", pageNum)
-				return
-			}
-			msgs, err = caller().PageToken(msgs.NextPageToken).Do()
+			ret <- fetchMessage(srv, rateLimiter, user, m.Id, plan)
+		}
+		if msgs.NextPageToken == "" {
+			return
 		}
-	}(ret, srv, user, pageSize, pageLimit, labelIds...)
 
-	return ret, total
+		pageNum++
+		if pageLimit > 0 && pageNum >= pageLimit {
+			logger.Debugf("Limit of '%d' message pages reached", pageNum)
+			return
+		}
+		msgs, err = caller().PageToken(msgs.NextPageToken).Do()
+	}
 }
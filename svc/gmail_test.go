@@ -0,0 +1,247 @@
+package svc
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Returns a part tree with attachments nested within a forwarded message.
+func testNestedPayload() *gmail.MessagePart {
+	return &gmail.MessagePart{PartId: "", MimeType: "multipart/mixed", Parts: []*gmail.MessagePart{
+		{PartId: "0", MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{
+			{PartId: "0.0", MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: "dGV4dA"}},
+			{PartId: "0.1", MimeType: "text/html", Body: &gmail.MessagePartBody{Data: "PHA-aHRtbDwvcD4"}},
+		}},
+		testAttachmentPart("1", "", "a.pdf", "%PDF-a"),
+		{PartId: "2", MimeType: "message/rfc822", Parts: []*gmail.MessagePart{
+			{PartId: "2.0", MimeType: "multipart/mixed", Parts: []*gmail.MessagePart{
+				{PartId: "2.0.0", MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: "dGV4dA"}},
+				testAttachmentPart("2.0.1", "", "b.pdf", "%PDF-b"),
+				testAttachmentPart("2.0.2", "", "a.pdf", "%PDF-c"),
+			}},
+		}},
+	}}
+}
+
+func TestWalkParts(t *testing.T) {
+	paths := make(map[string][]string)
+	walkParts(testNestedPayload(), nil, func(part *gmail.MessagePart, path []string) {
+		paths[part.PartId] = path
+	})
+	for _, test := range []struct {
+		partId string
+		want   []string
+	}{
+		{"", nil},
+		{"0.1", []string{"multipart/mixed", "multipart/alternative"}},
+		{"1", []string{"multipart/mixed"}},
+		{"2.0.2", []string{"multipart/mixed", "message/rfc822", "multipart/mixed"}},
+	} {
+		if got := paths[test.partId]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.partId, test.want, got)
+		}
+	}
+	if len(paths) != 10 {
+		t.Errorf("expected all the parts visited, got %d", len(paths))
+	}
+	walkParts(nil, nil, func(part *gmail.MessagePart, path []string) {
+		t.Error("unexpected visit of a missing part")
+	})
+}
+
+func TestIsAttachment(t *testing.T) {
+	header := func(name, value string) []*gmail.MessagePartHeader {
+		return []*gmail.MessagePartHeader{{Name: name, Value: value}}
+	}
+	for _, test := range []struct {
+		name string
+		part *gmail.MessagePart
+		want bool
+	}{
+		{"body", &gmail.MessagePart{MimeType: "text/plain"}, false},
+		{"named", &gmail.MessagePart{Filename: "a.pdf"}, true},
+		{"attachment disposition", &gmail.MessagePart{Filename: "a.png", Headers: header("Content-Disposition", `Attachment; filename="a.png"`)}, true},
+		{"inline disposition", &gmail.MessagePart{Filename: "a.png", Headers: header("Content-Disposition", "inline")}, false},
+		{"referenced", &gmail.MessagePart{Filename: "a.png", Headers: header("Content-ID", "<img1>")}, false},
+	} {
+		if got := isAttachment(test.part); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSaveNestedAttachments(t *testing.T) {
+	dir := t.TempDir()
+	opts := &AttachmentOptions{Dir: dir, Names: NewUniqueFilenames(CollisionCounter)}
+	msg := &gmail.Message{Id: "m1", Payload: testNestedPayload()}
+	attachments, err := SaveAttachments(nil, nil, &DirOutput{}, opts, "me", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		partId  string
+		name    string
+		nesting string
+		content string
+	}{
+		{"1", "a.pdf", "multipart/mixed", "%PDF-a"},
+		{"2.0.1", "b.pdf", "multipart/mixed > message/rfc822 > multipart/mixed", "%PDF-b"},
+		{"2.0.2", "a.pdf", "multipart/mixed > message/rfc822 > multipart/mixed", "%PDF-c"},
+	} {
+		if i >= len(attachments) {
+			t.Fatalf("expected 3 attachments, got %d", len(attachments))
+		}
+		attachment := attachments[i]
+		if attachment.PartId != test.partId || attachment.OriginalFilename != test.name || attachment.NestingPath != test.nesting {
+			t.Errorf("%s: unexpected attachment %+v", test.partId, attachment)
+		}
+		if data, err := os.ReadFile(attachment.Filename); err != nil || string(data) != test.content {
+			t.Errorf("%s: unexpected content %q (%v)", test.partId, data, err)
+		}
+	}
+	// same names get distinct files
+	if attachments[0].Filename == attachments[2].Filename || filepath.Dir(attachments[0].Filename) != dir {
+		t.Errorf("unexpected files %s and %s", attachments[0].Filename, attachments[2].Filename)
+	}
+}
+
+func TestGetPartData(t *testing.T) {
+	for _, test := range []struct {
+		body    *gmail.MessagePartBody
+		want    string
+		wantErr bool
+	}{
+		{nil, "", false},
+		{&gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("data?>"))}, "data?>", false},
+		{&gmail.MessagePartBody{Data: "not base64!"}, "", true},
+	} {
+		got, err := getPartData(nil, nil, "me", "m1", &gmail.MessagePart{Body: test.body})
+		if (err != nil) != test.wantErr || string(got) != test.want {
+			t.Errorf("%v: unexpected data %q (%v)", test.body, got, err)
+		}
+	}
+}
+
+// Returns an html body referencing an image through its Content-ID, along
+// with an inline part declaring no file name.
+func testInlinePayload() *gmail.MessagePart {
+	return &gmail.MessagePart{PartId: "", MimeType: "multipart/related", Parts: []*gmail.MessagePart{
+		{PartId: "0", MimeType: "text/html", Body: &gmail.MessagePartBody{
+			Data: base64.URLEncoding.EncodeToString([]byte(`<img src="cid:logo@example">`)),
+		}},
+		{PartId: "1", MimeType: "image/png", Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-ID", Value: "<logo@example>"},
+		}, Body: &gmail.MessagePartBody{Size: 3, Data: base64.URLEncoding.EncodeToString([]byte("PNG"))}},
+		testAttachmentPart("2", "", "a.pdf", "%PDF-a"),
+	}}
+}
+
+func TestIsInline(t *testing.T) {
+	contentId := []*gmail.MessagePartHeader{{Name: "Content-Id", Value: " <img1> "}}
+	for _, test := range []struct {
+		name string
+		part *gmail.MessagePart
+		want bool
+	}{
+		{"referenced image", &gmail.MessagePart{MimeType: "image/png", Headers: contentId}, true},
+		{"named inline", &gmail.MessagePart{MimeType: "image/png", Filename: "a.png", Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-Disposition", Value: "inline; filename=a.png"},
+		}}, true},
+		{"unreferenced image", &gmail.MessagePart{MimeType: "image/png"}, false},
+		{"attachment", &gmail.MessagePart{MimeType: "image/png", Filename: "a.png"}, false},
+		{"html body", &gmail.MessagePart{MimeType: "text/html", Headers: contentId}, false},
+		{"multipart", &gmail.MessagePart{MimeType: "multipart/related", Headers: contentId}, false},
+	} {
+		if got := isInline(test.part); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+	if got := partContentId(&gmail.MessagePart{Headers: contentId}); got != "img1" {
+		t.Errorf("unexpected content id %s", got)
+	}
+}
+
+func TestInlineFilename(t *testing.T) {
+	for _, test := range []struct {
+		mimeType string
+		want     string
+	}{
+		{"image/jpeg", "inline-1.2.jpg"},
+		{"IMAGE/PNG", "inline-1.2.png"},
+		{"text/css", "inline-1.2.css"},
+		{"application/x-unknown", "inline-1.2"},
+	} {
+		if got := inlineFilename(&gmail.MessagePart{PartId: "1.2", MimeType: test.mimeType}); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.mimeType, test.want, got)
+		}
+	}
+}
+
+func TestSaveInlineParts(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		inline bool
+		store  bool
+		want   []string
+	}{
+		{"attachments only", false, false, []string{"a.pdf"}},
+		{"inline", true, false, []string{"inline-1.png", "a.pdf"}},
+		{"inline stored", true, true, []string{"inline-1.png", "a.pdf"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &AttachmentOptions{Dir: filepath.Join(dir, "att"), Names: NewUniqueFilenames(CollisionCounter), Inline: test.inline}
+			if test.store {
+				opts.Store = NewContentStore(filepath.Join(dir, "store"), StoreLinkNone, false)
+			}
+			msg := &gmail.Message{Id: "m1", Payload: testInlinePayload()}
+			attachments, err := SaveAttachments(nil, nil, &DirOutput{}, opts, "me", msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0)
+			for _, attachment := range attachments {
+				names = append(names, attachment.OriginalFilename)
+				if _, err := os.Stat(attachment.Filename); err != nil {
+					t.Errorf("%s: not saved: %v", attachment.OriginalFilename, err)
+				}
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, names)
+			}
+			if !test.inline {
+				return
+			}
+			inline, attachment := attachments[0], attachments[1]
+			if !inline.Inline || inline.ContentId != "logo@example" || string(inline.data) != "PNG" {
+				t.Errorf("unexpected inline part %+v", inline)
+			}
+			// attachments are not kept in memory
+			if attachment.Inline || attachment.data != nil {
+				t.Errorf("unexpected attachment %+v", attachment)
+			}
+
+			// the html body references the saved part
+			pages, err := NewHtmlPages(&DirOutput{}, filepath.Join(dir, "pages"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			textBody, htmlBody := GetBodies(msg.Payload)
+			exported := &ExportedMessage{Message: msg, TextBody: textBody, HtmlBody: htmlBody, Attachments: attachments}
+			if err := pages.Write(exported); err != nil {
+				t.Fatal(err)
+			}
+			page, _ := os.ReadFile(filepath.Join(dir, "pages", "m1.html"))
+			link := filepath.ToSlash(relativePath(filepath.Join(dir, "pages"), inline.Filename))
+			if !strings.Contains(string(page), `src="`+link+`"`) {
+				t.Errorf("expected a link to %s in %s", link, page)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package svc
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed archive
+var archiveAssets embed.FS
+
+var archiveTemplates = template.Must(template.ParseFS(archiveAssets, "archive/*.tmpl"))
+
+// Length of the body excerpt indexed for the client side search.
+const archiveSearchExcerpt = 2000
+
+// Entry of the archive index, loaded by the browser from data.js.
+type htmlIndexEntry struct {
+	Id          string   `json:"id"`
+	Thread      string   `json:"thread"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Subject     string   `json:"subject"`
+	Date        int64    `json:"date"`
+	Size        int64    `json:"size"`
+	Labels      []string `json:"labels"`
+	Attachments int      `json:"attachments"`
+	Snippet     string   `json:"snippet"`
+	Text        string   `json:"text"`
+	Page        string   `json:"page"`
+}
+
+type htmlLink struct {
+	Name string
+	Href string
+}
+
+// Data model of the message page template.
+type htmlMessagePage struct {
+	Id          string
+	Thread      string
+	From        string
+	To          string
+	Cc          string
+	Subject     string
+	Date        string
+	Labels      []string
+	Eml         *htmlLink
+	Attachments []*htmlLink
+	HtmlBody    template.HTML
+	TextBody    string
+}
+
+// HtmlArchive is a static, browsable html archive of the exported messages,
+// working offline from a folder or a zip.
+type HtmlArchive struct {
+	Dir string
+
+	out        Output
+	labelNames map[string]string
+	entries    []*htmlIndexEntry
+}
+
+func NewHtmlArchive(out Output, dir string, labelNames map[string]string) (*HtmlArchive, error) {
+	if err := out.MkdirAll(filepath.Join(dir, "messages")); err != nil {
+		return nil, err
+	}
+	if err := out.MkdirAll(filepath.Join(dir, "assets")); err != nil {
+		return nil, err
+	}
+	return &HtmlArchive{Dir: dir, out: out, labelNames: labelNames}, nil
+}
+
+// Returns the url of target (as referenced by the output) relative to the
+// messages folder.
+func (a *HtmlArchive) relativeLink(target string) string {
+	return relativeUrl(a.out, filepath.Join(a.Dir, "messages"), target)
+}
+
+func (a *HtmlArchive) Write(msg *ExportedMessage) error {
+	labels := GetLabelNamesOf(a.labelNames, msg.LabelIds)
+	sort.Strings(labels)
+
+	page := &htmlMessagePage{
+		Id:       msg.Id,
+		Thread:   msg.ThreadId,
+		From:     DecodeHeader(GetHeader(msg.Message, "From")),
+		To:       DecodeHeader(GetHeader(msg.Message, "To")),
+		Cc:       DecodeHeader(GetHeader(msg.Message, "Cc")),
+		Subject:  GetHeader(msg.Message, "Subject"),
+		Date:     time.UnixMilli(msg.InternalDate).Format(time.RFC1123Z),
+		Labels:   labels,
+		TextBody: msg.TextBody,
+	}
+	if msg.HtmlBody != "" {
+		// inline images point at the saved parts
+		body := rewriteCids(msg.HtmlBody, msg.Attachments, func(attachment *LocalAttachment) string {
+			return a.relativeLink(attachment.Filename)
+		})
+		page.HtmlBody = template.HTML(SanitizeHtml(body))
+	}
+	if msg.Eml != "" {
+		page.Eml = &htmlLink{Name: filepath.Base(msg.Eml), Href: a.relativeLink(msg.Eml)}
+	}
+	for _, attachment := range SavedAttachments(msg.Attachments) {
+		page.Attachments = append(page.Attachments, &htmlLink{
+			Name: filepath.Base(attachment.Filename),
+			Href: a.relativeLink(attachment.Filename),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := archiveTemplates.ExecuteTemplate(&buf, "message.html.tmpl", page); err != nil {
+		return err
+	}
+	pageFile := filepath.Join(a.Dir, "messages", msg.Id+".html")
+	if err := a.out.WriteFile(pageFile, buf.Bytes(), time.Time{}); err != nil {
+		return err
+	}
+
+	text := msg.TextBody
+	if text == "" {
+		text = msg.Snippet
+	}
+	if len(text) > archiveSearchExcerpt {
+		text = strings.ToValidUTF8(text[:archiveSearchExcerpt], "")
+	}
+	a.entries = append(a.entries, &htmlIndexEntry{
+		Id:          msg.Id,
+		Thread:      msg.ThreadId,
+		From:        page.From,
+		To:          page.To,
+		Subject:     page.Subject,
+		Date:        msg.InternalDate,
+		Size:        msg.SizeEstimate,
+		Labels:      labels,
+		Attachments: len(page.Attachments),
+		Snippet:     msg.Snippet,
+		Text:        text,
+		Page:        "messages/" + msg.Id + ".html",
+	})
+	return nil
+}
+
+// Writes the index page along with its assets.
+func (a *HtmlArchive) Close() error {
+	data, err := json.Marshal(a.entries)
+	if err != nil {
+		return err
+	}
+	// loaded through a script tag, as browsers don't allow fetching local files
+	js := fmt.Sprintf("var ARCHIVE_DATA = %s;\n", data)
+	if err := a.out.WriteFile(filepath.Join(a.Dir, "assets", "data.js"), []byte(js), time.Time{}); err != nil {
+		return err
+	}
+	for _, asset := range []string{"archive.js", "archive.css"} {
+		content, err := archiveAssets.ReadFile("archive/" + asset)
+		if err != nil {
+			return err
+		}
+		if err := a.out.WriteFile(filepath.Join(a.Dir, "assets", asset), content, time.Time{}); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := archiveTemplates.ExecuteTemplate(&buf, "index.html.tmpl", len(a.entries)); err != nil {
+		return err
+	}
+	return a.out.WriteFile(filepath.Join(a.Dir, "index.html"), buf.Bytes(), time.Time{})
+}
@@ -0,0 +1,363 @@
+package svc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the integrity manifest files, written into the export folder.
+const (
+	IntegrityManifestName = "integrity.json"
+	IntegritySumsName     = "SHA256SUMS"
+)
+
+// Kinds of the files listed by the integrity manifest.
+const (
+	IntegrityKindEml        = "eml"
+	IntegrityKindAttachment = "attachment"
+	IntegrityKindOutput     = "output"
+)
+
+// Entry of the integrity manifest, for an exported file.
+type IntegrityEntry struct {
+	// Relative to the manifest folder, with forward slashes
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	// SHA-256 of the decompressed content of compressed EMLs
+	ContentSha256 string `json:"content_sha256,omitempty"`
+	MessageId     string `json:"message_id,omitempty"`
+	AttachmentId  string `json:"attachment_id,omitempty"`
+}
+
+// IntegrityManifest lists the exported files along with their hashes, so
+// that they can be verified later on.
+type IntegrityManifest struct {
+	Generator string            `json:"generator"`
+	Created   time.Time         `json:"created"`
+	Files     []*IntegrityEntry `json:"files"`
+}
+
+// Integrity hashes every file written to the wrapped output. Its sink relates
+// EMLs and attachments to their messages, writing the manifest when closed.
+type Integrity struct {
+	Output
+	Dir string
+
+	entries map[string]*IntegrityEntry
+	mutex   sync.Mutex
+}
+
+// Returns an output wrapping out, writing the manifest into dir. Entries of
+// an existing manifest are kept when keep is set, i.e. when appending.
+func NewIntegrity(out Output, dir string, keep bool) (*Integrity, error) {
+	i := &Integrity{Output: out, Dir: dir, entries: make(map[string]*IntegrityEntry)}
+	if keep {
+		manifest, err := ReadIntegrityManifest(filepath.Join(dir, IntegrityManifestName))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if manifest != nil {
+			for _, entry := range manifest.Files {
+				i.entries[entry.Path] = entry
+			}
+		}
+	}
+	return i, nil
+}
+
+// Returns the wrapped output.
+func (i *Integrity) Unwrap() Output {
+	return i.Output
+}
+
+// Returns the manifest path of a file written as name.
+func (i *Integrity) entryPath(name string) string {
+	return relativePath(i.Output.Path(i.Dir), i.Output.Path(name))
+}
+
+func (i *Integrity) record(name string, size int64, sum []byte, contentSum []byte) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	path := i.entryPath(name)
+	entry, ok := i.entries[path]
+	if !ok {
+		entry = &IntegrityEntry{Path: path, Kind: IntegrityKindOutput}
+		i.entries[path] = entry
+	}
+	entry.Size = size
+	entry.Sha256 = hex.EncodeToString(sum)
+	entry.ContentSha256 = ""
+	if contentSum != nil {
+		entry.ContentSha256 = hex.EncodeToString(contentSum)
+	}
+}
+
+func (i *Integrity) WriteFile(name string, data []byte, modTime time.Time) error {
+	if err := i.Output.WriteFile(name, data, modTime); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	var contentSum []byte
+	if isCompressedEml(name) {
+		// proves the content even when compressed again
+		r, err := decompressReader(name, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		contentSum = h.Sum(nil)
+	}
+	i.record(name, int64(len(data)), sum[:], contentSum)
+	return nil
+}
+
+func (i *Integrity) Create(name string) (io.WriteCloser, error) {
+	w, err := i.Output.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingWriter{WriteCloser: w, name: name, hash: sha256.New(), integrity: i}, nil
+}
+
+// hashingWriter hashes a progressively written file, recorded once closed.
+type hashingWriter struct {
+	io.WriteCloser
+	name      string
+	hash      hash.Hash
+	size      int64
+	integrity *Integrity
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *hashingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.integrity.record(w.name, w.size, w.hash.Sum(nil), nil)
+	return nil
+}
+
+// Returns the sink completing the manifest, to be closed after any other
+// sink writing files.
+func (i *Integrity) Sink() MessageSink {
+	return &integritySink{i}
+}
+
+type integritySink struct {
+	i *Integrity
+}
+
+// Relates the EML and the attachments of a message to it. Attachments not
+// written by this export (i.e. links to stored ones) are listed after the
+// hash computed when saving them.
+func (s *integritySink) Write(msg *ExportedMessage) error {
+	i := s.i
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if msg.Eml != "" {
+		if entry, ok := i.entries[relativePath(i.Output.Path(i.Dir), msg.Eml)]; ok {
+			entry.Kind = IntegrityKindEml
+			entry.MessageId = msg.Id
+		}
+	}
+	for _, attachment := range SavedAttachments(msg.Attachments) {
+		path := relativePath(i.Output.Path(i.Dir), attachment.Filename)
+		entry, ok := i.entries[path]
+		if !ok {
+			entry = &IntegrityEntry{Path: path, Size: attachment.Size, Sha256: attachment.Sha256}
+			i.entries[path] = entry
+		}
+		entry.Kind = IntegrityKindAttachment
+		entry.MessageId = msg.Id
+		entry.AttachmentId = attachment.AttachmentId
+	}
+	return nil
+}
+
+// Writes the manifest, along with a file in the sha256sum format.
+func (s *integritySink) Close() error {
+	i := s.i
+	i.mutex.Lock()
+	manifest := &IntegrityManifest{Generator: "gmail-exporter", Created: time.Now(), Files: make([]*IntegrityEntry, 0, len(i.entries))}
+	for _, entry := range i.entries {
+		manifest.Files = append(manifest.Files, entry)
+	}
+	i.mutex.Unlock()
+	sort.Slice(manifest.Files, func(a, b int) bool { return manifest.Files[a].Path < manifest.Files[b].Path })
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := i.Output.WriteFile(filepath.Join(i.Dir, IntegrityManifestName), data, time.Time{}); err != nil {
+		return err
+	}
+	var sums strings.Builder
+	for _, entry := range manifest.Files {
+		fmt.Fprintf(&sums, "%s  %s\n", entry.Sha256, entry.Path)
+	}
+	return i.Output.WriteFile(filepath.Join(i.Dir, IntegritySumsName), []byte(sums.String()), time.Time{})
+}
+
+func ReadIntegrityManifest(filename string) (*IntegrityManifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &IntegrityManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", filename, err)
+	}
+	return manifest, nil
+}
+
+// IntegrityReport is the outcome of the verification of an export.
+type IntegrityReport struct {
+	Verified int
+	Missing  []string
+	Modified []string
+	// Files within the folder not listed by the manifest
+	Extra []string
+}
+
+func (r *IntegrityReport) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Modified) == 0 && len(r.Extra) == 0
+}
+
+// Returns the size and the SHA-256 of a file.
+func hashFile(filename string) (int64, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, bufio.NewReader(f))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the SHA-256 of the decompressed content of an EML file.
+func hashEmlContent(filename string) (string, error) {
+	r, err := OpenEml(filename)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the top level folders holding the listed files, where extra files
+// are looked for. Files alongside the manifest are not checked, as it may be
+// written into a folder holding unrelated ones (i.e. the working one).
+func exportFolders(manifest *IntegrityManifest) []string {
+	seen := make(map[string]bool)
+	folders := make([]string, 0)
+	for _, entry := range manifest.Files {
+		i := strings.Index(entry.Path, "/")
+		if i < 0 || entry.Path[:i] == ".." {
+			continue
+		}
+		if folder := entry.Path[:i]; !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// Returns whether a file has been left by DirOutput, i.e. .report.pdf.tmp
+func isTempFile(filename string) bool {
+	base := filepath.Base(filename)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp")
+}
+
+// Hashes again the files listed by the integrity manifest of dir, reporting
+// the missing, modified and extra ones. Compressed EMLs are decompressed,
+// so that they match even when compressed again.
+func VerifyIntegrity(dir string) (*IntegrityReport, error) {
+	manifest, err := ReadIntegrityManifest(filepath.Join(dir, IntegrityManifestName))
+	if err != nil {
+		return nil, err
+	}
+	report := &IntegrityReport{}
+	listed := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		listed[entry.Path] = true
+		filename := filepath.Join(dir, filepath.FromSlash(entry.Path))
+		size, sum, err := hashFile(filename)
+		switch {
+		case os.IsNotExist(err):
+			report.Missing = append(report.Missing, entry.Path)
+		case err != nil:
+			return nil, err
+		case size == entry.Size && sum == entry.Sha256:
+			report.Verified++
+		case entry.ContentSha256 != "":
+			if content, err := hashEmlContent(filename); err == nil && content == entry.ContentSha256 {
+				report.Verified++
+			} else {
+				report.Modified = append(report.Modified, entry.Path)
+			}
+		default:
+			report.Modified = append(report.Modified, entry.Path)
+		}
+	}
+	for _, folder := range exportFolders(manifest) {
+		err = filepath.WalkDir(filepath.Join(dir, folder), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					// reported as missing files
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel := relativePath(dir, path)
+			// temporary files are left by interrupted writes
+			if !listed[rel] && !isTempFile(path) {
+				report.Extra = append(report.Extra, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,183 @@
+package svc
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Exports a workbook, an attachment and a compressed EML into dir, along
+// with the integrity manifest.
+func testIntegrityExport(t *testing.T, dir string) {
+	t.Helper()
+	integrity, err := NewIntegrity(&DirOutput{}, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := filepath.Join(dir, "attachments", "ab", "report.pdf")
+	eml := filepath.Join(dir, "eml", "m1.eml.zst")
+	compressor, err := NewEmlCompressor(EmlCompressZstd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := compressor.Compress([]byte("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		filepath.Join(dir, "messages.xlsx"): []byte("workbook"),
+		attachment:                          []byte("%PDF-1.4"),
+		eml:                                 compressed,
+	} {
+		if err := integrity.WriteFile(name, data, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink := integrity.Sink()
+	msg := &ExportedMessage{
+		Message: &gmail.Message{Id: "m1"},
+		Eml:     eml,
+		Attachments: []*LocalAttachment{
+			{Filename: attachment, AttachmentId: "att1", Size: 8},
+		},
+	}
+	if err := sink.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegrityManifest(t *testing.T) {
+	dir := t.TempDir()
+	testIntegrityExport(t, dir)
+
+	manifest, err := ReadIntegrityManifest(filepath.Join(dir, IntegrityManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, entry := range manifest.Files {
+		kinds[entry.Path] = entry.Kind + " " + entry.MessageId + " " + entry.AttachmentId
+		if entry.Path == "eml/m1.eml.zst" && entry.ContentSha256 == "" {
+			t.Errorf("missing content hash of compressed EML")
+		}
+	}
+	expected := map[string]string{
+		"messages.xlsx":             "output  ",
+		"attachments/ab/report.pdf": "attachment m1 att1",
+		"eml/m1.eml.zst":            "eml m1 ",
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("expected %v, got %v", expected, kinds)
+	}
+	if _, err := os.Stat(filepath.Join(dir, IntegritySumsName)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(dir string) error
+		want   IntegrityReport
+	}{
+		{"untouched", nil, IntegrityReport{Verified: 3}},
+		{"unrelated files alongside the manifest", func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "token.json"), []byte("{}"), 0644)
+		}, IntegrityReport{Verified: 3}},
+		{"temporary files", func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "attachments", "ab", ".other.pdf.tmp"), []byte("x"), 0644)
+		}, IntegrityReport{Verified: 3}},
+		{"missing", func(dir string) error {
+			return os.Remove(filepath.Join(dir, "attachments", "ab", "report.pdf"))
+		}, IntegrityReport{Verified: 2, Missing: []string{"attachments/ab/report.pdf"}}},
+		{"modified", func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "messages.xlsx"), []byte("changed"), 0644)
+		}, IntegrityReport{Verified: 2, Modified: []string{"messages.xlsx"}}},
+		{"extra", func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "eml", "m2.eml"), []byte("x"), 0644)
+		}, IntegrityReport{Verified: 3, Extra: []string{"eml/m2.eml"}}},
+		{"recompressed", func(dir string) error {
+			compressor, err := NewEmlCompressor(EmlCompressZstd, 19)
+			if err != nil {
+				return err
+			}
+			data, err := compressor.Compress([]byte("Subject: test\r\n\r\nbody\r\n"))
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "eml", "m1.eml.zst"), data, 0644)
+		}, IntegrityReport{Verified: 3}},
+		{"modified EML content", func(dir string) error {
+			compressor, _ := NewEmlCompressor(EmlCompressZstd, 0)
+			data, err := compressor.Compress([]byte("Subject: changed\r\n\r\nbody\r\n"))
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "eml", "m1.eml.zst"), data, 0644)
+		}, IntegrityReport{Verified: 2, Modified: []string{"eml/m1.eml.zst"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			testIntegrityExport(t, dir)
+			if test.change != nil {
+				if err := test.change(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := VerifyIntegrity(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*report, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, *report)
+			}
+			if report.Ok() != (len(test.want.Missing)+len(test.want.Modified)+len(test.want.Extra) == 0) {
+				t.Errorf("unexpected outcome %v", report.Ok())
+			}
+		})
+	}
+}
+
+func TestEmlCompressionRoundTrip(t *testing.T) {
+	content := []byte("Subject: round trip\r\n\r\nbody\r\n")
+	for _, format := range []string{EmlCompressGzip, EmlCompressZstd} {
+		compressor, err := NewEmlCompressor(format, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := compressor.Compress(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), "m.eml"+compressor.Ext())
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !isCompressedEml(filename) {
+			t.Errorf("%s not recognized as compressed", filename)
+		}
+		r, err := OpenEml(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(content) {
+			t.Errorf("%s: expected %q, got %q", format, content, got)
+		}
+	}
+	if _, err := NewEmlCompressor(EmlCompressGzip, 10); err == nil {
+		t.Error("expected an error for an invalid gzip level")
+	}
+}
@@ -0,0 +1,170 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidecavestro/gmail-exporter/logger"
+	"go.uber.org/zap"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Maildir++ folders for the gmail system labels that make sense as folders.
+// INBOX maps to the maildir root.
+var maildirSystemFolders = map[string]string{
+	"INBOX": "",
+	"SENT":  ".Sent",
+	"DRAFT": ".Drafts",
+	"SPAM":  ".Junk",
+	"TRASH": ".Trash",
+}
+
+// Folder used for messages not carrying any label mapped to a folder
+// (i.e. archived messages).
+const maildirArchiveFolder = ".Archive"
+
+// Returns the Maildir++ subfolders (relative to the maildir root) for the
+// labels of a message.
+func maildirFolders(labelNames map[string]string, labelIds []string) []string {
+	folders := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, labelId := range labelIds {
+		folder, system := maildirSystemFolders[labelId]
+		if !system {
+			name, ok := labelNames[labelId]
+			if !ok || strings.HasPrefix(labelId, "CATEGORY_") || isGmailStateLabel(labelId) {
+				// not a user label
+				continue
+			}
+			segments := strings.Split(name, "/")
+			for i, segment := range segments {
+				// dots are the Maildir++ hierarchy separator
+				segments[i] = strings.NewReplacer(".", "_", string(os.PathSeparator), "_").Replace(segment)
+			}
+			folder = "." + strings.Join(segments, ".")
+		}
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	if len(folders) == 0 {
+		folders = append(folders, maildirArchiveFolder)
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// Returns the Maildir info flags (already sorted) for the labels of a message.
+func maildirFlags(labelIds []string) string {
+	unread := false
+	flags := make([]string, 0)
+	for _, labelId := range labelIds {
+		switch labelId {
+		case "UNREAD":
+			unread = true
+		case "STARRED":
+			flags = append(flags, "F")
+		case "DRAFT":
+			flags = append(flags, "D")
+		}
+	}
+	if !unread {
+		flags = append(flags, "S")
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, "")
+}
+
+func isGmailStateLabel(labelId string) bool {
+	switch labelId {
+	case "UNREAD", "STARRED", "IMPORTANT", "CHAT":
+		return true
+	}
+	return false
+}
+
+// Returns a unique file name for a message, following the maildir naming
+// conventions. The gmail message id keeps it unique across deliveries.
+func maildirUniqueName(message *gmail.Message) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+	received := time.UnixMilli(message.InternalDate)
+	return fmt.Sprintf("%d.M%dG%s.%s", received.Unix(), received.Nanosecond()/1000, message.Id, host)
+}
+
+// Maildir saves raw messages into a Maildir++ tree, a folder for every
+// label.
+type Maildir struct {
+	Dir string
+
+	out        Output
+	labelNames map[string]string
+	// folders prepared so far
+	folders map[string]bool
+	mutex   sync.Mutex
+}
+
+func NewMaildir(out Output, dir string, labelNames map[string]string) *Maildir {
+	return &Maildir{Dir: dir, out: out, labelNames: labelNames, folders: make(map[string]bool)}
+}
+
+// Creates the subfolders of a folder, marking it as a Maildir++ one, unless
+// already done.
+func (m *Maildir) prepare(folder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.folders[folder] {
+		return nil
+	}
+	folderPath := filepath.Join(m.Dir, folder)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := m.out.MkdirAll(filepath.Join(folderPath, sub)); err != nil {
+			return err
+		}
+	}
+	if folder != "" {
+		// marks the folder as a Maildir++ subfolder
+		if err := m.out.WriteFile(filepath.Join(folderPath, "maildirfolder"), []byte{}, time.Time{}); err != nil {
+			return err
+		}
+	}
+	m.folders[folder] = true
+	return nil
+}
+
+// Saves the raw message, once for every Maildir++ folder mapped from the
+// message labels. Returns the path of the first saved file.
+func (m *Maildir) Save(srv *gmail.Service, user string, msg *gmail.Message) (string, error) {
+	message, decodedData, err := rawMessage(srv, user, msg)
+	if err != nil {
+		return "", err
+	}
+
+	received := time.UnixMilli(message.InternalDate)
+	name := maildirUniqueName(message) + ":2," + maildirFlags(message.LabelIds)
+
+	ret := ""
+	for _, folder := range maildirFolders(m.labelNames, message.LabelIds) {
+		if err := m.prepare(folder); err != nil {
+			logger.Fatal("Unable to prepare maildir: ", zap.Error(err))
+		}
+		// outputs write files atomically, so no need to deliver through tmp
+		filename := filepath.Join(m.Dir, folder, "cur", name)
+		if err := m.out.WriteFile(filename, decodedData, received); err != nil {
+			return "", err
+		}
+		if ret == "" {
+			ret = m.out.Path(filename)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,109 @@
+package svc
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestMaildirFolders(t *testing.T) {
+	labelNames := map[string]string{
+		"Label_1": "Work/Projects",
+		"Label_2": "v1.2",
+	}
+	for _, test := range []struct {
+		labelIds []string
+		want     []string
+	}{
+		{[]string{"INBOX", "UNREAD"}, []string{""}},
+		{[]string{"SENT", "INBOX"}, []string{"", ".Sent"}},
+		{[]string{"Label_1", "IMPORTANT", "CATEGORY_UPDATES"}, []string{".Work.Projects"}},
+		{[]string{"Label_2"}, []string{".v1_2"}},
+		{[]string{"STARRED", "Label_9"}, []string{maildirArchiveFolder}},
+		{nil, []string{maildirArchiveFolder}},
+		{[]string{"TRASH", "SPAM", "DRAFT"}, []string{".Drafts", ".Junk", ".Trash"}},
+	} {
+		if got := maildirFolders(labelNames, test.labelIds); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: expected %v, got %v", test.labelIds, test.want, got)
+		}
+	}
+}
+
+func TestMaildirFlags(t *testing.T) {
+	for _, test := range []struct {
+		labelIds []string
+		want     string
+	}{
+		{nil, "S"},
+		{[]string{"UNREAD"}, ""},
+		{[]string{"STARRED"}, "FS"},
+		{[]string{"DRAFT", "UNREAD", "STARRED"}, "DF"},
+	} {
+		if got := maildirFlags(test.labelIds); got != test.want {
+			t.Errorf("%v: expected %q, got %q", test.labelIds, test.want, got)
+		}
+	}
+}
+
+func TestMaildirUniqueName(t *testing.T) {
+	msg := &gmail.Message{Id: "m1", InternalDate: time.Date(2023, 1, 31, 23, 30, 0, 1000, time.UTC).UnixMilli()}
+	name := maildirUniqueName(msg)
+	if !strings.HasPrefix(name, "1675207800.M0Gm1.") || strings.ContainsAny(name, "/:") {
+		t.Errorf("unexpected name %q", name)
+	}
+}
+
+// Counts the files written through an output.
+type countingOutput struct {
+	DirOutput
+	writes map[string]int
+}
+
+func (o *countingOutput) WriteFile(name string, data []byte, modTime time.Time) error {
+	o.writes[name]++
+	return o.DirOutput.WriteFile(name, data, modTime)
+}
+
+func TestMaildirSave(t *testing.T) {
+	dir := t.TempDir()
+	out := &countingOutput{writes: make(map[string]int)}
+	maildir := NewMaildir(out, dir, map[string]string{"Label_1": "Work"})
+	for _, id := range []string{"m1", "m2"} {
+		msg := &gmail.Message{
+			Id:       id,
+			LabelIds: []string{"INBOX", "Label_1", "UNREAD"},
+			Raw:      base64.URLEncoding.EncodeToString([]byte("Subject: " + id + "\r\n\r\nbody\r\n")),
+		}
+		path, err := maildir.Save(nil, "me", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != filepath.Join(dir, "cur") || !strings.HasSuffix(path, ":2,") {
+			t.Errorf("unexpected path %s", path)
+		}
+	}
+	marker := filepath.Join(dir, ".Work", "maildirfolder")
+	if out.writes[marker] != 1 {
+		t.Errorf("expected the folder marker written once, got %d", out.writes[marker])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "maildirfolder")); !os.IsNotExist(err) {
+		t.Error("unexpected marker in the maildir root")
+	}
+	for _, folder := range []string{"", ".Work"} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if _, err := os.Stat(filepath.Join(dir, folder, sub)); err != nil {
+				t.Error(err)
+			}
+		}
+		entries, _ := os.ReadDir(filepath.Join(dir, folder, "cur"))
+		if len(entries) != 2 {
+			t.Errorf("%q: expected 2 messages, got %d", folder, len(entries))
+		}
+	}
+}
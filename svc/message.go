@@ -0,0 +1,104 @@
+package svc
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ExportedMessage is a message fetched from gmail, along with its bodies and
+// the artifacts locally saved for it.
+type ExportedMessage struct {
+	*gmail.Message
+
+	TextBody    string
+	HtmlBody    string
+	Eml         string
+	Attachments []*LocalAttachment
+}
+
+// MessageSink is an additional output receiving every exported message.
+type MessageSink interface {
+	Write(msg *ExportedMessage) error
+	// Finalizes the output once all messages have been written.
+	Close() error
+}
+
+// Returns the value of the first header matching name, or an empty string.
+func GetHeader(msg *gmail.Message, name string) string {
+	if msg.Payload == nil {
+		return ""
+	}
+	for _, h := range msg.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// Returns the text and html bodies of a message, concatenating the relevant
+// parts found walking the whole part tree.
+func GetBodies(part *gmail.MessagePart) (string, string) {
+	if part == nil {
+		return "", ""
+	}
+	text := ""
+	html := ""
+	if part.Filename == "" && part.Body != nil && part.Body.Data != "" {
+		if part.MimeType == "text/plain" {
+			data, _ := base64.URLEncoding.DecodeString(part.Body.Data)
+			text = string(data)
+		} else if part.MimeType == "text/html" {
+			data, _ := base64.URLEncoding.DecodeString(part.Body.Data)
+			html = string(data)
+		}
+	}
+	for _, inner := range part.Parts {
+		innerText, innerHtml := GetBodies(inner)
+		if innerText != "" {
+			text = joinNonEmpty("\n", text, innerText)
+		}
+		if innerHtml != "" {
+			html = joinNonEmpty("\n", html, innerHtml)
+		}
+	}
+	return text, html
+}
+
+func joinNonEmpty(sep string, elems ...string) string {
+	nonEmpty := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		if elem != "" {
+			nonEmpty = append(nonEmpty, elem)
+		}
+	}
+	return concat(sep, nonEmpty...)
+}
+
+// Returns the label names indexed by label id.
+func GetLabelNames(srv *gmail.Service, user string) (map[string]string, error) {
+	labels, err := ListLabels(srv, user)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for _, label := range labels {
+		ret[label.Id] = label.Name
+	}
+	return ret, nil
+}
+
+// Returns the names of the given labels, falling back on their ids.
+func GetLabelNamesOf(labelNames map[string]string, labelIds []string) []string {
+	ret := make([]string, 0, len(labelIds))
+	for _, labelId := range labelIds {
+		if name, ok := labelNames[labelId]; ok {
+			ret = append(ret, name)
+		} else {
+			ret = append(ret, labelId)
+		}
+	}
+	return ret
+}
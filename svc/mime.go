@@ -0,0 +1,233 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Fetch plans, selecting how messages are retrieved.
+const (
+	// Structured messages, fetching the raw source again for EMLs and
+	// attachments separately
+	FetchFull = "full"
+	// Raw messages only, parsed locally: saves quota at the expense of CPU
+	FetchRaw = "raw"
+)
+
+// Max nesting of the multipart parts parsed from raw messages.
+const maxPartDepth = 50
+
+// Parses the source of a message fetched in RAW format, filling its payload
+// as the full format would: headers, part tree and bodies, with attachments
+// embedded as data rather than referenced by id.
+func ParseRawMessage(msg *gmail.Message) error {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return fmt.Errorf("invalid raw message %s: %v", msg.Id, err)
+	}
+	msg.Payload = parsePart(raw, "", "text/plain", true, 0)
+	return nil
+}
+
+// Splits a header block from the content, unfolding continuation lines.
+func parseHeaders(data []byte) ([]*gmail.MessagePartHeader, []byte) {
+	headers := make([]*gmail.MessagePartHeader, 0)
+	var last *gmail.MessagePartHeader
+	for len(data) > 0 {
+		line := data
+		next := []byte(nil)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, next = data[:i], data[i+1:]
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			return headers, next
+		}
+		data = next
+		if line[0] == ' ' || line[0] == '\t' {
+			if last != nil {
+				last.Value += " " + strings.TrimSpace(string(line))
+			}
+			continue
+		}
+		if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			last = &gmail.MessagePartHeader{
+				Name:  strings.TrimSpace(string(line[:colon])),
+				Value: strings.TrimSpace(string(line[colon+1:])),
+			}
+			headers = append(headers, last)
+		}
+	}
+	return headers, nil
+}
+
+// Returns the parts of a multipart content, without preamble and epilogue.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := "--" + boundary
+	parts := make([][]byte, 0)
+	var current []byte
+	inPart := false
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line = body[:i+1]
+		}
+		body = body[len(line):]
+		trimmed := string(bytes.TrimRight(line, " \t\r\n"))
+		if trimmed == delimiter || trimmed == delimiter+"--" {
+			if inPart {
+				// the line break before the delimiter belongs to it
+				current = bytes.TrimSuffix(bytes.TrimSuffix(current, []byte("\n")), []byte("\r"))
+				parts = append(parts, current)
+			}
+			if trimmed != delimiter {
+				return parts
+			}
+			current = make([]byte, 0)
+			inPart = true
+			continue
+		}
+		if inPart {
+			current = append(current, line...)
+		}
+	}
+	if inPart {
+		// truncated messages miss the closing delimiter
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// Decodes a content as of its Content-Transfer-Encoding, keeping it as is
+// when malformed.
+func decodeTransferEncoding(body []byte, encoding string) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, body)
+		if decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(string(clean), "=")); err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		// keeps what has been decoded before any error
+		decoded, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return decoded
+	}
+	return body
+}
+
+// Converts a text body to UTF-8, as of its charset.
+func decodeCharset(body []byte, charset string) []byte {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return body
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return body
+	}
+	if decoded, err := enc.NewDecoder().Bytes(body); err == nil {
+		return decoded
+	}
+	return body
+}
+
+// Returns the id of the child of a part, as Gmail does: zero based and dot
+// separated, i.e. 1.0 for the first child of the second part.
+func childPartId(partId string, i int) string {
+	if partId == "" {
+		return fmt.Sprint(i)
+	}
+	return fmt.Sprintf("%s.%d", partId, i)
+}
+
+// Headers holding address lists, kept encoded: their display names are
+// decoded when parsed, while decoding them first could add separators, i.e.
+// =?UTF-8?Q?Doe=2C_John?= <john@example.com>
+var addressHeaders = map[string]bool{
+	"from":                        true,
+	"sender":                      true,
+	"reply-to":                    true,
+	"to":                          true,
+	"cc":                          true,
+	"bcc":                         true,
+	"resent-from":                 true,
+	"resent-sender":               true,
+	"resent-to":                   true,
+	"resent-cc":                   true,
+	"resent-bcc":                  true,
+	"return-path":                 true,
+	"delivered-to":                true,
+	"disposition-notification-to": true,
+}
+
+// Parses a MIME entity as a message part identified by partId. The
+// unstructured headers of messages (the top level one and the encapsulated
+// ones) are decoded, as by the full format.
+func parsePart(data []byte, partId string, defaultType string, message bool, depth int) *gmail.MessagePart {
+	headers, body := parseHeaders(data)
+	part := &gmail.MessagePart{PartId: partId, Headers: headers, MimeType: defaultType, Body: &gmail.MessagePartBody{}}
+	if message {
+		for _, h := range headers {
+			name := strings.ToLower(h.Name)
+			if !strings.HasPrefix(name, "content-") && !addressHeaders[name] {
+				h.Value = DecodeHeader(h.Value)
+			}
+		}
+	}
+	var params map[string]string
+	if mediaType, p, err := mime.ParseMediaType(partHeader(part, "Content-Type")); err == nil {
+		part.MimeType = strings.ToLower(mediaType)
+		params = p
+	}
+	if _, p, err := mime.ParseMediaType(partHeader(part, "Content-Disposition")); err == nil && p["filename"] != "" {
+		part.Filename = p["filename"]
+	} else if params["name"] != "" {
+		part.Filename = params["name"]
+	}
+
+	if strings.HasPrefix(part.MimeType, "multipart/") && params["boundary"] != "" && depth < maxPartDepth {
+		childType := "text/plain"
+		if part.MimeType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for i, child := range splitMultipart(body, params["boundary"]) {
+			part.Parts = append(part.Parts, parsePart(child, childPartId(partId, i), childType, false, depth+1))
+		}
+		return part
+	}
+
+	decoded := decodeTransferEncoding(body, partHeader(part, "Content-Transfer-Encoding"))
+	if part.MimeType == "message/rfc822" && depth < maxPartDepth {
+		// forwarded messages have their entity as only child, while their
+		// source is kept as body to be saved as an attachment
+		part.Parts = []*gmail.MessagePart{parsePart(decoded, childPartId(partId, 0), "text/plain", true, depth+1)}
+	} else if part.Filename == "" && (part.MimeType == "text/plain" || part.MimeType == "text/html") {
+		decoded = decodeCharset(decoded, params["charset"])
+	}
+	part.Body.Data = base64.URLEncoding.EncodeToString(decoded)
+	part.Body.Size = int64(len(decoded))
+	return part
+}
+
+// Returns the raw source of a message, fetching it unless already retrieved
+// through the raw fetch plan.
+func rawMessage(srv *gmail.Service, user string, msg *gmail.Message) (*gmail.Message, []byte, error) {
+	if msg.Raw != "" {
+		data, err := base64.URLEncoding.DecodeString(msg.Raw)
+		return msg, data, err
+	}
+	return GetRawMessage(srv, user, msg.Id)
+}
@@ -0,0 +1,245 @@
+package svc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func parseTestMessage(t *testing.T, source string) *gmail.Message {
+	t.Helper()
+	msg := &gmail.Message{Id: "m1", Raw: base64.URLEncoding.EncodeToString([]byte(strings.ReplaceAll(source, "\n", "\r\n")))}
+	if err := ParseRawMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Returns the tree of a part as a list of "id type filename".
+func partTree(part *gmail.MessagePart) []string {
+	ret := make([]string, 0)
+	walkParts(part, nil, func(p *gmail.MessagePart, path []string) {
+		ret = append(ret, strings.TrimSpace(fmt.Sprintf("%s %s %s", p.PartId, p.MimeType, p.Filename)))
+	})
+	return ret
+}
+
+func findPart(part *gmail.MessagePart, partId string) *gmail.MessagePart {
+	var ret *gmail.MessagePart
+	walkParts(part, nil, func(p *gmail.MessagePart, path []string) {
+		if p.PartId == partId {
+			ret = p
+		}
+	})
+	return ret
+}
+
+func partData(t *testing.T, part *gmail.MessagePart) string {
+	t.Helper()
+	data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseRawMessageHeaders(t *testing.T) {
+	msg := parseTestMessage(t, `From: =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>
+To: =?UTF-8?Q?Doe=2C_John?= <john@example.com>, jane@example.com
+Subject: a folded
+ subject
+X-Empty:
+Content-Type: text/plain; charset=utf-8
+
+body
+`)
+	for name, want := range map[string]string{
+		"From":    "=?UTF-8?Q?Jos=C3=A9?= <jose@example.com>",
+		"Subject": "a folded subject",
+		"X-Empty": "",
+	} {
+		if got := GetHeader(msg, name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+	if got := partData(t, msg.Payload); got != "body\r\n" {
+		t.Errorf("unexpected body %q", got)
+	}
+	// address headers are left to the address parser
+	for header, want := range map[string][]string{
+		"From": {"José <jose@example.com>"},
+		"To":   {"Doe, John <john@example.com>", " <jane@example.com>"},
+	} {
+		got := make([]string, 0)
+		for _, address := range ParseAddressList(GetHeader(msg, header)) {
+			got = append(got, address.Name+" <"+address.Address+">")
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestParseRawMessageParts(t *testing.T) {
+	msg := parseTestMessage(t, `Subject: parts
+Content-Type: multipart/mixed; boundary="outer"
+
+preamble
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+caff=E8 =
+lungo
+--inner
+Content-Type: multipart/related; boundary=related
+
+--related
+Content-Type: text/html; charset=utf-8
+
+<img src="cid:logo@example">
+--related
+Content-Type: image/png
+Content-ID: <logo@example>
+Content-Disposition: inline
+Content-Transfer-Encoding: base64
+
+UE5HREFUQQ==
+--related--
+--inner--
+--outer
+Content-Type: application/pdf; name="ignored.pdf"
+Content-Disposition: attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf
+Content-Transfer-Encoding: base64
+
+JVBERi0x
+LjQ=
+--outer--
+epilogue
+`)
+	expected := []string{
+		"multipart/mixed",
+		"0 multipart/alternative",
+		"0.0 text/plain",
+		"0.1 multipart/related",
+		"0.1.0 text/html",
+		"0.1.1 image/png",
+		"1 application/pdf résumé.pdf",
+	}
+	if got := partTree(msg.Payload); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if got := partData(t, findPart(msg.Payload, "0.0")); got != "caffè lungo" {
+		t.Errorf("unexpected text body %q", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "0.1.1")); got != "PNGDATA" {
+		t.Errorf("unexpected inline part %q", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "1")); got != "%PDF-1.4" {
+		t.Errorf("unexpected attachment %q", got)
+	}
+	if inline := findPart(msg.Payload, "0.1.1"); !isInline(inline) || partContentId(inline) != "logo@example" {
+		t.Errorf("expected an inline part with content id")
+	}
+	if !isAttachment(findPart(msg.Payload, "1")) {
+		t.Errorf("expected an attachment")
+	}
+}
+
+func TestParseRawMessageForwarded(t *testing.T) {
+	msg := parseTestMessage(t, `Subject: Fwd: report
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: text/plain
+
+see below
+--outer
+Content-Type: message/rfc822
+Content-Disposition: attachment; filename="report.eml"
+
+Subject: =?UTF-8?Q?r=C3=A9port?=
+Content-Type: multipart/mixed; boundary=forwarded
+
+--forwarded
+Content-Type: text/plain
+
+original body
+--forwarded
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="report.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQ=
+--forwarded--
+--outer--
+`)
+	expected := []string{
+		"multipart/mixed",
+		"0 text/plain",
+		"1 message/rfc822 report.eml",
+		"1.0 multipart/mixed",
+		"1.0.0 text/plain",
+		"1.0.1 application/pdf report.pdf",
+	}
+	if got := partTree(msg.Payload); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	forwarded := findPart(msg.Payload, "1.0")
+	if got := partHeader(forwarded, "Subject"); got != "réport" {
+		t.Errorf("unexpected forwarded subject %q", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "1.0.1")); got != "%PDF-1.4" {
+		t.Errorf("unexpected forwarded attachment %q", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "1")); !strings.HasPrefix(got, "Subject: =?UTF-8?Q?r=C3=A9port?=") {
+		t.Errorf("expected the forwarded source as body, got %q", got)
+	}
+	attachments := make([]string, 0)
+	walkParts(msg.Payload, nil, func(p *gmail.MessagePart, path []string) {
+		if isAttachment(p) {
+			attachments = append(attachments, p.PartId)
+		}
+	})
+	if !reflect.DeepEqual(attachments, []string{"1", "1.0.1"}) {
+		t.Errorf("unexpected attachments %v", attachments)
+	}
+	text, _ := GetBodies(msg.Payload)
+	if !strings.Contains(text, "see below") || !strings.Contains(text, "original body") {
+		t.Errorf("unexpected text body %q", text)
+	}
+}
+
+func TestParseRawMessageMalformed(t *testing.T) {
+	// missing closing delimiter, invalid base64 kept as is
+	msg := parseTestMessage(t, `Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: text/plain
+Content-Transfer-Encoding: base64
+
+not base64!
+--b
+Content-Type: text/plain
+
+truncated`)
+	if got := partTree(msg.Payload); len(got) != 3 {
+		t.Fatalf("unexpected parts %v", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "0")); got != "not base64!" {
+		t.Errorf("unexpected malformed body %q", got)
+	}
+	if got := partData(t, findPart(msg.Payload, "1")); got != "truncated" {
+		t.Errorf("unexpected truncated body %q", got)
+	}
+	if err := ParseRawMessage(&gmail.Message{Id: "m2", Raw: "not base64"}); err == nil {
+		t.Error("expected an error for invalid raw data")
+	}
+}
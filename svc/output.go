@@ -0,0 +1,283 @@
+package svc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output is the destination of the exported files: either the local
+// filesystem or a single archive bundle.
+type Output interface {
+	// Returns the path the file written as name is referenced with.
+	Path(name string) string
+	MkdirAll(name string) error
+	// Writes a whole file, setting its modification time when not zero.
+	WriteFile(name string, data []byte, modTime time.Time) error
+	// Creates a file to be progressively written, completed when closed.
+	Create(name string) (io.WriteCloser, error)
+	Close() error
+}
+
+// DirOutput writes files to the local filesystem.
+type DirOutput struct{}
+
+func (o *DirOutput) Path(name string) string {
+	return name
+}
+
+func (o *DirOutput) MkdirAll(name string) error {
+	return os.MkdirAll(name, os.ModePerm)
+}
+
+// Writes through a hidden temporary file, so that readers (i.e. maildir
+// clients) never see partial contents.
+func (o *DirOutput) WriteFile(name string, data []byte, modTime time.Time) error {
+	dir, base := filepath.Split(name)
+	if err := o.MkdirAll(filepath.Join(dir, ".")); err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(dir, "."+base+".tmp")
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmpFile, modTime, modTime); err != nil {
+			os.Remove(tmpFile)
+			return err
+		}
+	}
+	return os.Rename(tmpFile, name)
+}
+
+func (o *DirOutput) Create(name string) (io.WriteCloser, error) {
+	if err := o.MkdirAll(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+func (o *DirOutput) Close() error {
+	return nil
+}
+
+// Entry of the bundle manifest.
+type BundleEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// BundleManifest describes the contents of a bundle, written as its last
+// entry.
+type BundleManifest struct {
+	Generator string         `json:"generator"`
+	Created   time.Time      `json:"created"`
+	Files     []*BundleEntry `json:"files"`
+}
+
+const BundleManifestName = "manifest.json"
+
+type bundleWriter interface {
+	writeDir(name string) error
+	writeFile(name string, size int64, modTime time.Time, content io.Reader) error
+	Close() error
+}
+
+// BundleOutput streams files into a single zip or tar.gz archive, depending
+// on the archive extension. Files are referenced by their path relative to
+// the archive root.
+type BundleOutput struct {
+	file     *os.File
+	writer   bundleWriter
+	dirs     map[string]bool
+	files    map[string]bool
+	manifest *BundleManifest
+	mutex    sync.Mutex
+}
+
+func NewBundleOutput(filename string) (*BundleOutput, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	o := &BundleOutput{
+		file:     f,
+		dirs:     make(map[string]bool),
+		files:    make(map[string]bool),
+		manifest: &BundleManifest{Generator: "gmail-exporter", Created: time.Now(), Files: make([]*BundleEntry, 0)},
+	}
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		o.writer = &zipBundle{zip.NewWriter(f)}
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz := gzip.NewWriter(f)
+		o.writer = &tarBundle{gz: gz, tar: tar.NewWriter(gz)}
+	default:
+		f.Close()
+		os.Remove(filename)
+		return nil, fmt.Errorf("unsupported bundle format %s: use .zip or .tar.gz", filename)
+	}
+	return o, nil
+}
+
+// Returns the archive path for name: relative to the archive root, with
+// forward slashes.
+func (o *BundleOutput) Path(name string) string {
+	name = filepath.ToSlash(name)
+	if volume := filepath.VolumeName(name); volume != "" {
+		name = name[len(volume):]
+	}
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+func (o *BundleOutput) MkdirAll(name string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.mkdirAll(o.Path(name))
+}
+
+func (o *BundleOutput) mkdirAll(dir string) error {
+	if dir == "" || dir == "." || o.dirs[dir] {
+		return nil
+	}
+	if err := o.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	o.dirs[dir] = true
+	return o.writer.writeDir(dir + "/")
+}
+
+func (o *BundleOutput) WriteFile(name string, data []byte, modTime time.Time) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.add(o.Path(name), int64(len(data)), modTime, bytes.NewReader(data))
+}
+
+// Adds an entry to the archive. As entries cannot be overwritten, files
+// already added are kept.
+func (o *BundleOutput) add(name string, size int64, modTime time.Time, content io.Reader) error {
+	if o.files[name] {
+		return nil
+	}
+	o.files[name] = true
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	if err := o.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	if err := o.writer.writeFile(name, size, modTime, content); err != nil {
+		return err
+	}
+	o.manifest.Files = append(o.manifest.Files, &BundleEntry{Path: name, Size: size, Modified: modTime})
+	return nil
+}
+
+// Archives support a single entry being written at a time, so progressively
+// written files are spooled to a temporary file, then added once closed.
+func (o *BundleOutput) Create(name string) (io.WriteCloser, error) {
+	tmp, err := ioutil.TempFile("", "gmail-exporter-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spooledFile{File: tmp, name: o.Path(name), bundle: o}, nil
+}
+
+// Writes the manifest and completes the archive.
+func (o *BundleOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	manifest, err := json.MarshalIndent(o.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := o.writer.writeFile(BundleManifestName, int64(len(manifest)), time.Now(), bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	if err := o.writer.Close(); err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
+
+type spooledFile struct {
+	*os.File
+	name   string
+	bundle *BundleOutput
+}
+
+func (f *spooledFile) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+	size, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.bundle.mutex.Lock()
+	defer f.bundle.mutex.Unlock()
+	return f.bundle.add(f.name, size, time.Now(), f.File)
+}
+
+type zipBundle struct {
+	zip *zip.Writer
+}
+
+func (b *zipBundle) writeDir(name string) error {
+	_, err := b.zip.CreateHeader(&zip.FileHeader{Name: name, Modified: time.Now()})
+	return err
+}
+
+func (b *zipBundle) writeFile(name string, size int64, modTime time.Time, content io.Reader) error {
+	w, err := b.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (b *zipBundle) Close() error {
+	return b.zip.Close()
+}
+
+type tarBundle struct {
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+func (b *tarBundle) writeDir(name string) error {
+	return b.tar.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755, ModTime: time.Now()})
+}
+
+func (b *tarBundle) writeFile(name string, size int64, modTime time.Time, content io.Reader) error {
+	if err := b.tar.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := io.Copy(b.tar, content)
+	return err
+}
+
+func (b *tarBundle) Close() error {
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
@@ -0,0 +1,154 @@
+package svc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDirOutputWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a", "b.txt")
+	modTime := time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC)
+	out := &DirOutput{}
+	if err := out.WriteFile(name, []byte("content"), modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("expected %v, got %v", modTime, info.ModTime())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(name))
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files left, got %d entries", len(entries))
+	}
+}
+
+func TestBundleOutputPath(t *testing.T) {
+	o := &BundleOutput{}
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"messages.xlsx", "messages.xlsx"},
+		{"./attachments/ab/a.pdf", "attachments/ab/a.pdf"},
+		{"/tmp/export/a.pdf", "tmp/export/a.pdf"},
+		{"../../a.pdf", "a.pdf"},
+	} {
+		if got := o.Path(filepath.FromSlash(test.name)); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+		}
+	}
+}
+
+// Returns the entries of a bundle, with their contents.
+func readBundle(t *testing.T, filename string) map[string]string {
+	t.Helper()
+	ret := make(map[string]string)
+	if filepath.Ext(filename) == ".zip" {
+		z, err := zip.OpenReader(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			ret[f.Name] = string(data)
+		}
+		return ret
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		ret[header.Name] = string(data)
+	}
+}
+
+func TestBundleOutput(t *testing.T) {
+	for _, format := range []string{"zip", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "export."+format)
+			o, err := NewBundleOutput(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := o.WriteFile(filepath.Join("attachments", "ab", "a.pdf"), []byte("%PDF"), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			// entries cannot be overwritten, the first one is kept
+			if err := o.WriteFile(filepath.Join("attachments", "ab", "a.pdf"), []byte("other"), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.MkdirAll("empty"); err != nil {
+				t.Fatal(err)
+			}
+			w, err := o.Create("messages.xlsx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, "workbook")
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readBundle(t, filename)
+			names := make([]string, 0)
+			for name := range entries {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			expected := []string{"attachments/", "attachments/ab/", "attachments/ab/a.pdf", "empty/", BundleManifestName, "messages.xlsx"}
+			if !reflect.DeepEqual(names, expected) {
+				t.Fatalf("expected %v, got %v", expected, names)
+			}
+			if entries["attachments/ab/a.pdf"] != "%PDF" || entries["messages.xlsx"] != "workbook" {
+				t.Errorf("unexpected contents %v", entries)
+			}
+			var manifest BundleManifest
+			if err := json.Unmarshal([]byte(entries[BundleManifestName]), &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest.Files) != 2 || manifest.Files[0].Path != "attachments/ab/a.pdf" || manifest.Files[1].Size != 8 {
+				t.Errorf("unexpected manifest %+v", manifest.Files)
+			}
+		})
+	}
+	if _, err := NewBundleOutput(filepath.Join(t.TempDir(), "export.rar")); err == nil {
+		t.Error("expected an unsupported format error")
+	}
+}
@@ -0,0 +1,100 @@
+package svc
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Policies applied to values exceeding the Excel cell limit.
+const (
+	// Cut the value, appending a marker
+	CellOverflowTruncate = "truncate"
+	// Continue the value on continuation columns
+	CellOverflowSplit = "split"
+	// Move the value to a file next to the workbook, linking it
+	CellOverflowSidecar = "sidecar"
+)
+
+// Appended to truncated values.
+const truncatedMarker = "…[truncated]"
+
+// Excel limits cells to 32767 characters: counting bytes keeps on the safe
+// side for any encoding.
+const maxCellLength = excelize.TotalCellChars
+
+var sidecarNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Returns the longest prefix of value fitting within size bytes, without
+// breaking runes.
+func cutString(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
+
+func truncateCell(value string) string {
+	if len(value) <= maxCellLength {
+		return value
+	}
+	return cutString(value, maxCellLength-len(truncatedMarker)) + truncatedMarker
+}
+
+// Returns the cells for the value of a column spanning parts physical
+// columns, applying the overflow policy to values not fitting a cell.
+func overflowCells(column *Column, value interface{}, parts int, msg *ExportedMessage, opts *SpreadsheetOptions) ([]interface{}, error) {
+	ret := make([]interface{}, parts)
+	ret[0] = value
+	str, ok := value.(string)
+	if !ok || len(str) <= maxCellLength {
+		return ret, nil
+	}
+	if !column.Long {
+		ret[0] = truncateCell(str)
+		return ret, nil
+	}
+	switch opts.CellOverflow {
+	case CellOverflowSplit:
+		for i := 0; i < parts && str != ""; i++ {
+			if i == parts-1 {
+				ret[i] = truncateCell(str)
+				break
+			}
+			chunk := cutString(str, maxCellLength)
+			ret[i] = chunk
+			str = str[len(chunk):]
+		}
+	case CellOverflowSidecar:
+		filename, err := saveSidecar(column, str, msg, opts)
+		if err != nil {
+			return nil, err
+		}
+		ret[0] = fileLinkCell(filename, opts)
+	default:
+		ret[0] = truncateCell(str)
+	}
+	return ret, nil
+}
+
+// Writes a value to a sidecar file, returning its path as referenced by the
+// output.
+func saveSidecar(column *Column, value string, msg *ExportedMessage, opts *SpreadsheetOptions) (string, error) {
+	ext := ".txt"
+	if column.Name == "html_body" {
+		ext = ".html"
+	}
+	name := fmt.Sprintf("%s-%s%s", msg.Id, sidecarNameChars.ReplaceAllString(column.Name, "_"), ext)
+	filename := filepath.Join(opts.SidecarDir, name)
+	if err := opts.Output.WriteFile(filename, []byte(value), time.UnixMilli(msg.InternalDate)); err != nil {
+		return "", err
+	}
+	return opts.Output.Path(filename), nil
+}
@@ -0,0 +1,107 @@
+package svc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCutString(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		size  int
+		want  string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"aè", 2, "a"},
+		{"aè", 3, "aè"},
+		{"è", 1, ""},
+	} {
+		if got := cutString(test.value, test.size); got != test.want {
+			t.Errorf("%q %d: expected %q, got %q", test.value, test.size, test.want, got)
+		}
+	}
+}
+
+func TestTruncateCell(t *testing.T) {
+	fitting := strings.Repeat("a", maxCellLength)
+	if got := truncateCell(fitting); got != fitting {
+		t.Errorf("expected the value kept, got %d bytes", len(got))
+	}
+	got := truncateCell(strings.Repeat("è", maxCellLength))
+	if len(got) > maxCellLength || !strings.HasSuffix(got, truncatedMarker) {
+		t.Errorf("expected at most %d bytes ending with the marker, got %d", maxCellLength, len(got))
+	}
+}
+
+func TestOverflowCells(t *testing.T) {
+	long := strings.Repeat("a", maxCellLength) + strings.Repeat("b", maxCellLength) + "c"
+	truncated := truncateCell(long)
+	msg := &ExportedMessage{Message: testColumnMessage().Message}
+	body := &Column{Name: "text_body", Long: true}
+	subject := &Column{Name: "subject"}
+	for _, test := range []struct {
+		name     string
+		column   *Column
+		value    interface{}
+		parts    int
+		overflow string
+		want     []interface{}
+	}{
+		{"fitting", body, "short", 3, CellOverflowSplit, []interface{}{"short", nil, nil}},
+		{"not a string", body, int64(1), 1, CellOverflowSplit, []interface{}{int64(1)}},
+		{"default", body, long, 1, "", []interface{}{truncated}},
+		{"truncate", body, long, 1, CellOverflowTruncate, []interface{}{truncated}},
+		{"not long", subject, long, 1, CellOverflowSidecar, []interface{}{truncated}},
+		{"split", body, long, 3, CellOverflowSplit, []interface{}{
+			strings.Repeat("a", maxCellLength), strings.Repeat("b", maxCellLength), "c"}},
+		{"split short", body, strings.Repeat("a", maxCellLength+1), 3, CellOverflowSplit, []interface{}{
+			strings.Repeat("a", maxCellLength), "a", nil}},
+		{"split truncated", body, long, 2, CellOverflowSplit, []interface{}{
+			strings.Repeat("a", maxCellLength), truncateCell(strings.Repeat("b", maxCellLength) + "c")}},
+	} {
+		got, err := overflowCells(test.column, test.value, test.parts, msg, &SpreadsheetOptions{CellOverflow: test.overflow})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: unexpected cells", test.name)
+		}
+	}
+}
+
+func TestOverflowSidecar(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("a", maxCellLength+1)
+	msg := &ExportedMessage{Message: testColumnMessage().Message}
+	opts := &SpreadsheetOptions{
+		CellOverflow: CellOverflowSidecar,
+		WorkbookDir:  dir,
+		SidecarDir:   filepath.Join(dir, "sidecars"),
+		Output:       &DirOutput{},
+	}
+	for _, test := range []struct {
+		column *Column
+		name   string
+	}{
+		{&Column{Name: "text_body", Long: true}, "m1-text_body.txt"},
+		{&Column{Name: "html_body", Long: true}, "m1-html_body.html"},
+		{&Column{Name: "attachment text", Long: true}, "m1-attachment_text.txt"},
+	} {
+		got, err := overflowCells(test.column, long, 1, msg, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(opts.SidecarDir, test.name)
+		if want := fileLinkCell(filename, opts); !reflect.DeepEqual(got, []interface{}{want}) {
+			t.Errorf("%s: expected %v, got %v", test.column.Name, want, got)
+		}
+		if data, err := os.ReadFile(filename); err != nil || string(data) != long {
+			t.Errorf("%s: unexpected sidecar (%v)", test.column.Name, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var cidPattern = regexp.MustCompile(`(?i)cid:([^"'\s()<>]+)`)
+
+// Replaces the cid: urls of an html body referencing saved inline parts with
+// the url returned for them. Unknown references are kept.
+func rewriteCids(body string, attachments []*LocalAttachment, link func(attachment *LocalAttachment) string) string {
+	byId := make(map[string]*LocalAttachment)
+	for _, attachment := range SavedAttachments(attachments) {
+		if attachment.ContentId != "" {
+			byId[strings.ToLower(attachment.ContentId)] = attachment
+		}
+	}
+	if len(byId) == 0 {
+		return body
+	}
+	return cidPattern.ReplaceAllStringFunc(body, func(ref string) string {
+		id := ref[len("cid:"):]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		if attachment, ok := byId[strings.ToLower(id)]; ok {
+			if target := link(attachment); target != "" {
+				return target
+			}
+		}
+		return ref
+	})
+}
+
+// Returns the path of target relative to base, with forward slashes. Falls
+// back on target when not relatable.
+func relativePath(base string, target string) string {
+	if filepath.IsAbs(base) != filepath.IsAbs(target) {
+		absBase, errBase := filepath.Abs(base)
+		absTarget, errTarget := filepath.Abs(target)
+		if errBase == nil && errTarget == nil {
+			base, target = absBase, absTarget
+		}
+	}
+	if rel, err := filepath.Rel(base, target); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(target)
+}
+
+// Returns the path of target (as referenced by the output) relative to dir,
+// escaped so that it works as an url.
+func relativeUrl(out Output, dir string, target string) string {
+	return (&url.URL{Path: relativePath(out.Path(dir), target)}).EscapedPath()
+}
+
+// HtmlPages writes a self-contained html page per message, with the cid:
+// urls of the body pointing at the saved inline parts, or embedding them as
+// data URIs.
+type HtmlPages struct {
+	Dir string
+	// Embeds inline parts as data URIs, rather than linking the saved files
+	Embed bool
+
+	out Output
+}
+
+func NewHtmlPages(out Output, dir string, embed bool) (*HtmlPages, error) {
+	if err := out.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	return &HtmlPages{Dir: dir, Embed: embed, out: out}, nil
+}
+
+// Returns the content of an inline part, read back from the filesystem when
+// not kept in memory.
+func (p *HtmlPages) data(attachment *LocalAttachment) []byte {
+	if attachment.data != nil {
+		return attachment.data
+	}
+	if isDirOutput(p.out) {
+		if data, err := os.ReadFile(attachment.Filename); err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// Data model of the page template.
+type htmlPage struct {
+	Subject string
+	Body    template.HTML
+}
+
+// Messages without html body are skipped. Bodies are sanitized as for the
+// archive pages.
+func (p *HtmlPages) Write(msg *ExportedMessage) error {
+	if msg.HtmlBody == "" {
+		return nil
+	}
+	body := rewriteCids(msg.HtmlBody, msg.Attachments, func(attachment *LocalAttachment) string {
+		if p.Embed {
+			if data := p.data(attachment); data != nil {
+				return "data:" + attachment.MimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+			}
+		}
+		return relativeUrl(p.out, p.Dir, attachment.Filename)
+	})
+	var buf bytes.Buffer
+	page := &htmlPage{Subject: GetHeader(msg.Message, "Subject"), Body: template.HTML(SanitizeHtml(body))}
+	if err := archiveTemplates.ExecuteTemplate(&buf, "page.html.tmpl", page); err != nil {
+		return err
+	}
+	return p.out.WriteFile(filepath.Join(p.Dir, msg.Id+".html"), buf.Bytes(), time.UnixMilli(msg.InternalDate))
+}
+
+func (p *HtmlPages) Close() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package svc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestRewriteCids(t *testing.T) {
+	attachments := []*LocalAttachment{
+		{Filename: "logo.png", ContentId: "Logo@Example"},
+		{Filename: "skipped.png", ContentId: "skipped", Skipped: "filtered"},
+		nil,
+	}
+	for _, test := range []struct {
+		body string
+		want string
+	}{
+		{`<img src="cid:logo@example">`, `<img src="[logo.png]">`},
+		{`<img src='cid:LOGO%40example'>`, `<img src='[logo.png]'>`},
+		{`<td background=cid:logo@example>`, `<td background=[logo.png]>`},
+		{`<img src="cid:unknown">`, `<img src="cid:unknown">`},
+		{`<img src="cid:skipped">`, `<img src="cid:skipped">`},
+		{`no references`, `no references`},
+	} {
+		got := rewriteCids(test.body, attachments, func(attachment *LocalAttachment) string {
+			return "[" + attachment.Filename + "]"
+		})
+		if got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.body, test.want, got)
+		}
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	for _, test := range []struct {
+		base   string
+		target string
+		want   string
+	}{
+		{"pages", "attachments/ab/logo.png", "../attachments/ab/logo.png"},
+		{"out/pages", "out/pages/logo.png", "logo.png"},
+		{"/export/pages", "/export/a b/c.png", "../a b/c.png"},
+	} {
+		if got := relativePath(filepath.FromSlash(test.base), filepath.FromSlash(test.target)); got != test.want {
+			t.Errorf("%s %s: expected %s, got %s", test.base, test.target, test.want, got)
+		}
+	}
+	if got := relativeUrl(&DirOutput{}, "pages", filepath.FromSlash("attachments/a b#1.png")); got != "../attachments/a%20b%231.png" {
+		t.Errorf("unexpected url %s", got)
+	}
+}
+
+func TestHtmlPagesWrite(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		embed bool
+		want  []string
+	}{
+		{"linked", false, []string{`<img src="../att/logo.png"/>`}},
+		{"embedded", true, []string{`<img src="data:image/png;base64,UE5H"/>`}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pages, err := NewHtmlPages(&DirOutput{}, filepath.Join(dir, "pages"), test.embed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &ExportedMessage{
+				Message: &gmail.Message{Id: "m1", Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+					{Name: "Subject", Value: "<b>news</b>"},
+				}}},
+				HtmlBody: `<html><head><script>alert(1)</script></head><body onload="alert(2)">` +
+					`<img src="cid:logo"><img src="https://tracker/t.png"></body></html>`,
+				Attachments: []*LocalAttachment{{
+					Filename: filepath.Join(dir, "att", "logo.png"), MimeType: "image/png", ContentId: "logo", Inline: true, data: []byte("PNG"),
+				}},
+			}
+			if err := pages.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "pages", "m1.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := string(data)
+			for _, want := range append(test.want,
+				`<meta charset="utf-8">`, `Content-Security-Policy`, `<title>&lt;b&gt;news&lt;/b&gt;</title>`) {
+				if !strings.Contains(page, want) {
+					t.Errorf("missing %s in %s", want, page)
+				}
+			}
+			for _, unwanted := range []string{"alert", "tracker"} {
+				if strings.Contains(page, unwanted) {
+					t.Errorf("unexpected %s in %s", unwanted, page)
+				}
+			}
+		})
+	}
+	// messages without html body are skipped
+	dir := t.TempDir()
+	pages, _ := NewHtmlPages(&DirOutput{}, dir, false)
+	if err := pages.Write(&ExportedMessage{Message: &gmail.Message{Id: "m2"}, TextBody: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "m2.html")); !os.IsNotExist(err) {
+		t.Error("unexpected page for a text message")
+	}
+}
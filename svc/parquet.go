@@ -0,0 +1,129 @@
+package svc
+
+import (
+	"io"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+type ParquetAddress struct {
+	Name  string `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Email string `parquet:"name=email, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// ParquetMessage is the schema of the parquet output, one row per message.
+type ParquetMessage struct {
+	Id           string           `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ThreadId     string           `parquet:"name=thread_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	InternalDate int64            `parquet:"name=internal_date, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Date         *int64           `parquet:"name=date, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	Size         int64            `parquet:"name=size, type=INT64"`
+	From         []ParquetAddress `parquet:"name=from, type=LIST"`
+	To           []ParquetAddress `parquet:"name=to, type=LIST"`
+	Cc           []ParquetAddress `parquet:"name=cc, type=LIST"`
+	Bcc          []ParquetAddress `parquet:"name=bcc, type=LIST"`
+	ReplyTo      []ParquetAddress `parquet:"name=reply_to, type=LIST"`
+	Subject      string           `parquet:"name=subject, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Snippet      string           `parquet:"name=snippet, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TextBody     *string          `parquet:"name=text_body, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	HtmlBody     *string          `parquet:"name=html_body, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	LabelIds     []string         `parquet:"name=label_ids, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Labels       []string         `parquet:"name=labels, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Eml          *string          `parquet:"name=eml, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Attachments  []string         `parquet:"name=attachments, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// ParquetFile writes exported messages into a parquet file, flushing a row
+// group every RowGroupSize messages.
+type ParquetFile struct {
+	RowGroupSize int
+	NoHtmlBody   bool
+	NoTextBody   bool
+
+	labelNames map[string]string
+	file       io.WriteCloser
+	writer     *writer.ParquetWriter
+	pending    int
+}
+
+func NewParquetFile(out Output, filename string, labelNames map[string]string, rowGroupSize int, NoHtmlBody bool, NoTextBody bool) (*ParquetFile, error) {
+	f, err := out.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriterFromWriter(f, new(ParquetMessage), 1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ParquetFile{
+		RowGroupSize: rowGroupSize,
+		NoHtmlBody:   NoHtmlBody,
+		NoTextBody:   NoTextBody,
+		labelNames:   labelNames,
+		file:         f,
+		writer:       pw,
+	}, nil
+}
+
+func parquetAddresses(value string) []ParquetAddress {
+	ret := make([]ParquetAddress, 0)
+	for _, address := range ParseAddressList(value) {
+		ret = append(ret, ParquetAddress{Name: address.Name, Email: address.Address})
+	}
+	return ret
+}
+
+func (p *ParquetFile) Write(msg *ExportedMessage) error {
+	row := &ParquetMessage{
+		Id:           msg.Id,
+		ThreadId:     msg.ThreadId,
+		InternalDate: msg.InternalDate,
+		Size:         msg.SizeEstimate,
+		From:         parquetAddresses(GetHeader(msg.Message, "From")),
+		To:           parquetAddresses(GetHeader(msg.Message, "To")),
+		Cc:           parquetAddresses(GetHeader(msg.Message, "Cc")),
+		Bcc:          parquetAddresses(GetHeader(msg.Message, "Bcc")),
+		ReplyTo:      parquetAddresses(GetHeader(msg.Message, "Reply-To")),
+		Subject:      DecodeHeader(GetHeader(msg.Message, "Subject")),
+		Snippet:      msg.Snippet,
+		LabelIds:     append(make([]string, 0), msg.LabelIds...),
+		Labels:       GetLabelNamesOf(p.labelNames, msg.LabelIds),
+		Attachments:  make([]string, 0),
+	}
+	if date := ParseDateHeader(GetHeader(msg.Message, "Date")); !date.IsZero() {
+		millis := date.UnixMilli()
+		row.Date = &millis
+	}
+	if !p.NoTextBody {
+		row.TextBody = &msg.TextBody
+	}
+	if !p.NoHtmlBody {
+		row.HtmlBody = &msg.HtmlBody
+	}
+	if msg.Eml != "" {
+		row.Eml = &msg.Eml
+	}
+	for _, attachment := range SavedAttachments(msg.Attachments) {
+		row.Attachments = append(row.Attachments, attachment.Filename)
+	}
+
+	if err := p.writer.Write(row); err != nil {
+		return err
+	}
+	p.pending++
+	if p.RowGroupSize > 0 && p.pending >= p.RowGroupSize {
+		p.pending = 0
+		return p.writer.Flush(true)
+	}
+	return nil
+}
+
+// Flushes the last row group and writes the parquet footer.
+func (p *ParquetFile) Close() error {
+	if err := p.writer.WriteStop(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
@@ -0,0 +1,114 @@
+package svc
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParquetAddresses(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  []ParquetAddress
+	}{
+		{"", []ParquetAddress{}},
+		{"jane@example.com", []ParquetAddress{{Email: "jane@example.com"}}},
+		{`"Doe, John" <john@example.com>, =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>`, []ParquetAddress{
+			{Name: "Doe, John", Email: "john@example.com"},
+			{Name: "José", Email: "jose@example.com"},
+		}},
+	} {
+		if got := parquetAddresses(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.value, test.want, got)
+		}
+	}
+}
+
+// Writes the messages into a parquet file and reads them back.
+func testParquet(t *testing.T, noHtmlBody bool, msgs ...*ExportedMessage) []ParquetMessage {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "messages.parquet")
+	p, err := NewParquetFile(&DirOutput{}, filename, map[string]string{"INBOX": "INBOX", "Label_1": "Work"}, 1, noHtmlBody, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if err := p.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := local.NewLocalFileReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pr, err := reader.NewParquetReader(f, new(ParquetMessage), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	rows := make([]ParquetMessage, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestParquetFile(t *testing.T) {
+	date := time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC)
+	rows := testParquet(t, true,
+		&ExportedMessage{
+			Message: &gmail.Message{
+				Id:           "m1",
+				ThreadId:     "t1",
+				InternalDate: date.UnixMilli(),
+				SizeEstimate: 1234,
+				LabelIds:     []string{"INBOX", "Label_1"},
+				Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+					{Name: "From", Value: "Jane <jane@example.com>"},
+					{Name: "To", Value: "a@example.com, b@example.com"},
+					{Name: "Subject", Value: "=?UTF-8?Q?caff=C3=A8?="},
+					{Name: "Date", Value: date.Format(time.RFC1123Z)},
+				}},
+			},
+			TextBody: "text",
+			HtmlBody: "<p>html</p>",
+			Eml:      "eml/m1.eml",
+			Attachments: []*LocalAttachment{
+				{Filename: "att/a.pdf"},
+				{Filename: "att/b.png", Skipped: "filtered"},
+			},
+		},
+		&ExportedMessage{Message: &gmail.Message{Id: "m2", Payload: &gmail.MessagePart{}}},
+	)
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	m1 := rows[0]
+	if m1.Id != "m1" || m1.ThreadId != "t1" || m1.Size != 1234 || m1.Subject != "caffè" {
+		t.Errorf("unexpected row %+v", m1)
+	}
+	if m1.Date == nil || *m1.Date != date.UnixMilli() || m1.InternalDate != date.UnixMilli() {
+		t.Errorf("unexpected dates %v %v", m1.Date, m1.InternalDate)
+	}
+	if len(m1.From) != 1 || m1.From[0].Email != "jane@example.com" || len(m1.To) != 2 {
+		t.Errorf("unexpected addresses %v %v", m1.From, m1.To)
+	}
+	if !reflect.DeepEqual(m1.Labels, []string{"INBOX", "Work"}) || !reflect.DeepEqual(m1.Attachments, []string{"att/a.pdf"}) {
+		t.Errorf("unexpected labels %v or attachments %v", m1.Labels, m1.Attachments)
+	}
+	if m1.TextBody == nil || *m1.TextBody != "text" || m1.HtmlBody != nil || m1.Eml == nil || *m1.Eml != "eml/m1.eml" {
+		t.Errorf("unexpected bodies or eml %v %v %v", m1.TextBody, m1.HtmlBody, m1.Eml)
+	}
+	if m2 := rows[1]; m2.Date != nil || m2.Eml != nil || len(m2.From) != 0 {
+		t.Errorf("unexpected optional values %+v", m2)
+	}
+}
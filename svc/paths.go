@@ -0,0 +1,185 @@
+package svc
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// PathData is the data model of path templates, describing a message.
+type PathData struct {
+	ID     string
+	Thread string
+	Date   time.Time
+	// Zero padded parts of the date, i.e. 2023, 01, 31
+	Year  string
+	Month string
+	Day   string
+	// Names of all the labels
+	Labels []string
+	// First user label, or the first label when the message has none
+	Label      string
+	FromName   string
+	FromEmail  string
+	FromDomain string
+	// Subject without path separators
+	Subject string
+}
+
+// Max length of the subject slugs.
+const maxSlugLength = 60
+
+// Returns a lowercase version of s made of letters and digits separated by
+// dashes, i.e. "Re: Q3 report!" becomes "re-q3-report".
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return strings.TrimRight(cutString(b.String(), maxSlugLength), "-")
+}
+
+var pathFuncs = template.FuncMap{
+	"slug":  slug,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// PathTemplate places the files of every message after a text/template
+// executed on its PathData, i.e. {{.Year}}/{{.Month}}/{{.ID}}. Paths have to
+// tell messages apart.
+type PathTemplate struct {
+	tmpl       *template.Template
+	location   *time.Location
+	labelNames map[string]string
+	// message ids of the returned paths
+	used  map[string]string
+	mutex sync.Mutex
+}
+
+func NewPathTemplate(text string, location *time.Location, labelNames map[string]string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Funcs(pathFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		location = time.Local
+	}
+	t := &PathTemplate{tmpl: tmpl, location: location, labelNames: labelNames, used: make(map[string]string)}
+	// messages differing just by id must get different paths
+	sample := PathData{Thread: "sample", Date: time.Now(), Year: "2006", Month: "01", Day: "02", Labels: []string{"INBOX"},
+		Label: "INBOX", FromName: "Sender", FromEmail: "sender@example.com", FromDomain: "example.com", Subject: "Subject"}
+	first, second := sample, sample
+	first.ID, second.ID = "18a0000000000001", "18a0000000000002"
+	firstPath, err := t.execute(&first)
+	if err != nil {
+		return nil, err
+	}
+	secondPath, err := t.execute(&second)
+	if err != nil {
+		return nil, err
+	}
+	if firstPath == secondPath {
+		return nil, fmt.Errorf("path template '%s' does not yield unique paths: include {{.ID}}", text)
+	}
+	return t, nil
+}
+
+// Returns the data of a message for path templates.
+func (t *PathTemplate) data(msg *gmail.Message) *PathData {
+	date := time.UnixMilli(msg.InternalDate).In(t.location)
+	data := &PathData{
+		ID:      msg.Id,
+		Thread:  msg.ThreadId,
+		Date:    date,
+		Year:    date.Format("2006"),
+		Month:   date.Format("01"),
+		Day:     date.Format("02"),
+		Labels:  GetLabelNamesOf(t.labelNames, msg.LabelIds),
+		Subject: strings.NewReplacer("/", "_", `\`, "_").Replace(GetHeader(msg, "Subject")),
+	}
+	for i, labelId := range msg.LabelIds {
+		if strings.HasPrefix(labelId, "Label_") {
+			data.Label = data.Labels[i]
+			break
+		}
+	}
+	if data.Label == "" && len(data.Labels) > 0 {
+		data.Label = data.Labels[0]
+	}
+	if from := ParseAddressList(GetHeader(msg, "From")); len(from) > 0 {
+		data.FromName = from[0].Name
+		data.FromEmail = strings.ToLower(from[0].Address)
+		data.FromDomain = EmailDomain(from[0].Address)
+	}
+	return data
+}
+
+// Executes the template, sanitizing every segment of the resulting path.
+// Empty segments are dropped.
+func (t *PathTemplate) execute(data *PathData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	segments := make([]string, 0)
+	for _, segment := range strings.FieldsFunc(buf.String(), func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment = strings.TrimSpace(segment); segment != "" && segment != "." && segment != ".." {
+			segments = append(segments, SanitizeFilename(segment))
+		}
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("empty path")
+	}
+	return filepath.Join(segments...), nil
+}
+
+// Returns the path of a message, relative to the export folder. Fails when
+// clashing with the path of another message.
+func (t *PathTemplate) Path(msg *gmail.Message) (string, error) {
+	path, err := t.execute(t.data(msg))
+	if err != nil {
+		return "", fmt.Errorf("unable to apply the path template to message %s: %v", msg.Id, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if other, ok := t.used[path]; ok && other != msg.Id {
+		return "", fmt.Errorf("path template yields %s for both messages %s and %s", path, other, msg.Id)
+	}
+	t.used[path] = msg.Id
+	return path, nil
+}
+
+// Returns the subfolders of a message slicing its id: every seed entry is the
+// length of a slice, i.e. 2,3 for ab/cde.
+func seedPath(seed *[]int32, id string) string {
+	if seed == nil {
+		return ""
+	}
+	paths := make([]string, 0)
+	var last int32
+	for _, p := range *seed {
+		if p <= 0 || int(last+p) > len(id) {
+			break
+		}
+		paths = append(paths, id[last:last+p])
+		last += p
+	}
+	return filepath.Join(paths...)
+}
@@ -0,0 +1,122 @@
+package svc
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func testPathMessage(id string) *gmail.Message {
+	return &gmail.Message{
+		Id:           id,
+		ThreadId:     "t1",
+		InternalDate: time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC).UnixMilli(),
+		LabelIds:     []string{"INBOX", "Label_1"},
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "Jane Doe <Jane@Example.com>"},
+			{Name: "Subject", Value: "Re: Q3/Q4 report!"},
+		}},
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	labelNames := map[string]string{"INBOX": "INBOX", "Label_1": "Work/Projects"}
+	for _, test := range []struct {
+		text string
+		want string
+	}{
+		{"{{.Year}}/{{.Month}}/{{.Day}}/{{.ID}}", "2023/01/31/m1"},
+		{"{{.Label}}/{{.ID}}", "Work/Projects/m1"},
+		{"{{.FromDomain}}/{{.FromEmail}}/{{.ID}}", "example.com/jane@example.com/m1"},
+		{"{{.ID}}-{{slug .Subject}}", "m1-re-q3-q4-report"},
+		{"{{.ID}} {{.Subject}}", "m1 Re_ Q3_Q4 report!"},
+		{"../{{upper .ID}}/./", "M1"},
+		{"{{.ID}}/{{ index .Labels 0 | lower }}", "m1/inbox"},
+	} {
+		tmpl, err := NewPathTemplate(test.text, time.UTC, labelNames)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		got, err := tmpl.Path(testPathMessage("m1"))
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		if want := filepath.FromSlash(test.want); got != want {
+			t.Errorf("%s: expected %s, got %s", test.text, want, got)
+		}
+	}
+}
+
+func TestPathTemplateLocation(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+	tmpl, err := NewPathTemplate("{{.Year}}/{{.Month}}/{{.ID}}", location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:30 UTC is already february in Rome
+	if got, _ := tmpl.Path(testPathMessage("m1")); got != filepath.FromSlash("2023/02/m1") {
+		t.Errorf("expected the date in the location, got %s", got)
+	}
+}
+
+func TestPathTemplateInvalid(t *testing.T) {
+	for _, text := range []string{
+		"{{.Year}}/{{.Month}}",
+		"{{.Label}}",
+		"{{.Missing}}/{{.ID}}",
+		"{{.ID",
+		"{{ nope .ID }}",
+	} {
+		if _, err := NewPathTemplate(text, time.UTC, nil); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestPathTemplateClash(t *testing.T) {
+	// unique by id, yet the same for ids differing only in case once lowered
+	tmpl, err := NewPathTemplate("{{lower .ID}}", time.UTC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Path(testPathMessage("ab")); err != nil {
+		t.Fatal(err)
+	}
+	// the same message can be placed again
+	if _, err := tmpl.Path(testPathMessage("ab")); err != nil {
+		t.Error(err)
+	}
+	if _, err := tmpl.Path(testPathMessage("AB")); err == nil || !strings.Contains(err.Error(), "both messages") {
+		t.Errorf("expected a clash, got %v", err)
+	}
+}
+
+func TestSeedPath(t *testing.T) {
+	for _, test := range []struct {
+		seed []int32
+		want string
+	}{
+		{nil, ""},
+		{[]int32{2}, "ab"},
+		{[]int32{2, 3}, "ab/cde"},
+		{[]int32{1, 1, 1}, "a/b/c"},
+		{[]int32{4, 10}, "abcd"},
+		{[]int32{0, 2}, ""},
+	} {
+		seed := &test.seed
+		if test.seed == nil {
+			seed = nil
+		}
+		if got := seedPath(seed, "abcdef"); got != filepath.FromSlash(test.want) {
+			t.Errorf("%v: expected %s, got %s", test.seed, test.want, got)
+		}
+	}
+}
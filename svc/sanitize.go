@@ -0,0 +1,173 @@
+package svc
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements dropped along with their whole content.
+var unsafeElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Form:     true,
+	atom.Input:    true,
+	atom.Button:   true,
+	atom.Textarea: true,
+	atom.Select:   true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Base:     true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Title:    true,
+}
+
+// Attributes holding urls, checked against the allowed schemes.
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"background": true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"srcset":     true,
+	"cite":       true,
+	"longdesc":   true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+}
+
+// Attributes dropped altogether: ping leaks clicks, srcdoc embeds a whole
+// document and formtarget can open new browsing contexts.
+var droppedAttributes = map[string]bool{
+	"ping":       true,
+	"srcdoc":     true,
+	"formtarget": true,
+}
+
+// Returns a sanitized version of an html message body, suitable for offline
+// viewing: active contents, event handlers and remote resources are removed,
+// while links are kept.
+func SanitizeHtml(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return html.EscapeString(src)
+	}
+	var body *html.Node
+	var find func(n *html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Body && body == nil {
+			body = n
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+	if body == nil {
+		return ""
+	}
+	sanitizeNode(body)
+
+	var buf bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return html.EscapeString(src)
+		}
+	}
+	return buf.String()
+}
+
+func sanitizeNode(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.CommentNode, html.DoctypeNode:
+			n.RemoveChild(c)
+		case html.ElementNode:
+			if unsafeElements[c.DataAtom] || c.Namespace != "" {
+				n.RemoveChild(c)
+			} else {
+				c.Attr = sanitizeAttributes(c)
+				sanitizeNode(c)
+			}
+		}
+		c = next
+	}
+}
+
+func sanitizeAttributes(n *html.Node) []html.Attribute {
+	attrs := make([]html.Attribute, 0, len(n.Attr))
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		value := strings.TrimSpace(attr.Val)
+		switch {
+		case attr.Namespace != "", strings.HasPrefix(key, "on"), droppedAttributes[key]:
+			continue
+		case key == "style":
+			if !isSafeStyle(value) {
+				continue
+			}
+		case urlAttributes[key]:
+			if !isSafeUrl(n.DataAtom, key, value) {
+				continue
+			}
+		}
+		if n.DataAtom == atom.A && key == "target" {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	if n.DataAtom == atom.A {
+		// links leave the archive
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	return attrs
+}
+
+// Inline styles must not load resources. Escapes and comments are rejected
+// altogether, as they could hide the functions from the check, i.e. u\72l(
+func isSafeStyle(value string) bool {
+	lower := strings.ToLower(value)
+	if strings.Contains(lower, `\`) || strings.Contains(lower, "/*") {
+		return false
+	}
+	return !strings.Contains(lower, "url(") && !strings.Contains(lower, "expression(") &&
+		!strings.Contains(lower, "image-set(") && !strings.Contains(lower, "@import")
+}
+
+// Links can point to the web, while embedded resources have to be local:
+// remote ones would break offline viewing and leak read receipts.
+func isSafeUrl(element atom.Atom, key string, value string) bool {
+	lower := strings.ToLower(value)
+	if key == "href" && element == atom.A {
+		return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") ||
+			strings.HasPrefix(lower, "mailto:") || strings.HasPrefix(lower, "#")
+	}
+	if key == "src" && element == atom.Img {
+		return strings.HasPrefix(lower, "data:image/") || strings.HasPrefix(lower, "cid:") || isRelativeUrl(lower)
+	}
+	return false
+}
+
+func isRelativeUrl(value string) bool {
+	if value == "" || strings.HasPrefix(value, "//") {
+		return false
+	}
+	colon := strings.Index(value, ":")
+	return colon < 0 || strings.ContainsAny(value[:colon], "/?#")
+}
@@ -0,0 +1,28 @@
+package svc
+
+import "testing"
+
+func TestSanitizeHtml(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{`<p style="color:red">a</p>`, `<p style="color:red">a</p>`},
+		{`<p style="background:url(http://x/t.png)">a</p>`, `<p>a</p>`},
+		{`<p style="background:u\72l(http://x/t.png)">a</p>`, `<p>a</p>`},
+		{`<p style="background:u&#92;72l(http://x/t.png)">a</p>`, `<p>a</p>`},
+		{`<p style="background:u/**/rl(http://x/t.png)">a</p>`, `<p>a</p>`},
+		{`<p style="width:expression(alert(1))">a</p>`, `<p>a</p>`},
+		{`<p onclick="alert(1)">a</p><script>alert(1)</script>`, `<p>a</p>`},
+		{`<img src="http://x/t.png"><img src="cid:logo">`, `<img/><img src="cid:logo"/>`},
+		{`<a href="javascript:alert(1)">a</a>`, `<a target="_blank" rel="noopener noreferrer">a</a>`},
+		{`<a href="https://x/" ping="https://x/track">a</a>`, `<a href="https://x/" target="_blank" rel="noopener noreferrer">a</a>`},
+		{`<p PING="https://x/track" title="t">a</p>`, `<p title="t">a</p>`},
+		{`<div srcdoc="&lt;script&gt;alert(1)&lt;/script&gt;">a</div>`, `<div>a</div>`},
+		{`<p formtarget="_blank" class="c">a</p>`, `<p class="c">a</p>`},
+	} {
+		if got := SanitizeHtml(test.src); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.src, test.want, got)
+		}
+	}
+}
@@ -1,8 +1,7 @@
 package svc
 
 import (
-	"encoding/base64"
-	"strings"
+	"time"
 
 	"github.com/davidecavestro/gmail-exporter/logger"
 	"github.com/davidecavestro/gmail-exporter/ui"
@@ -13,179 +12,184 @@ import (
 type SaveMsgAttachments func(*gmail.Message) ([]*LocalAttachment, error)
 type SaveEml func(*gmail.Message) (string, error)
 
+// SpreadsheetOptions tunes the spreadsheet layout.
+type SpreadsheetOptions struct {
+	Columns []*Column
+	// Timezone of date cells, defaulting to the local one
+	Location *time.Location
+	// Directory of the workbook, as referenced by the output, for relative links
+	WorkbookDir string
+	// Email of the exported account, for links to the gmail web UI
+	Account string
+	// Label names by id, for label columns
+	LabelNames map[string]string
+	// Policy for values exceeding the cell limit, defaulting to truncate
+	CellOverflow string
+	// Continuation columns added to long columns by the split policy
+	SplitColumns int
+	// Directory of the files written by the sidecar policy, through Output
+	SidecarDir string
+	Output     Output
+	// Rows per sheet, header included, defaulting to the Excel limit
+	MaxRows int
+	// Policy applied when reaching MaxRows, defaulting to a new sheet
+	Rollover     string
+	SaveWorkbook SaveWorkbook
+	// Labels written on sheets of their own, after a summary sheet
+	LabelSheets []*gmail.Label
+	// Policy for messages carrying several of LabelSheets, defaulting to all
+	LabelDedup string
+	// Also write messages grouped by thread, on the last workbook
+	ThreadView bool
+	// Also write a sheet with a row for every address of every message
+	AddressesSheet bool
+	// Also write analytics sheets with charts, on the last workbook
+	Analytics bool
+	// Existing workbook to add messages to, rather than writing a new one
+	AppendTo *excelize.File
+}
+
+func (opts *SpreadsheetOptions) location() *time.Location {
+	if opts.Location == nil {
+		return time.Local
+	}
+	return opts.Location
+}
+
+// Saves the attachments and the EML of a message, extracting its bodies.
+func exportMessage(msg *gmail.Message, saveMsgAttachments SaveMsgAttachments, saveEml SaveEml) *ExportedMessage {
+	var attachments []*LocalAttachment = nil
+	var err error = nil
+	if saveMsgAttachments != nil {
+		attachments, err = saveMsgAttachments(msg)
+	}
+	if err != nil {
+		logger.Fatalf("Cannot save attachments: %v", err)
+	}
+
+	var emlFile string = ""
+	if saveEml != nil {
+		emlFile, err = saveEml(msg)
+		if err != nil {
+			logger.Fatalf("Cannot save message: %v", err)
+		}
+	}
+	textBody, htmlBody := GetBodies(msg.Payload)
+	return &ExportedMessage{Message: msg, TextBody: textBody, HtmlBody: htmlBody, Eml: emlFile, Attachments: attachments}
+}
+
 func ExportMessages(
 	msgs chan *gmail.Message, total int64, pui *ui.ProgressUI,
 	saveMsgAttachments SaveMsgAttachments,
-	saveEml SaveEml, NoHtmlBody bool, NoTextBody bool) *excelize.File {
+	saveEml SaveEml, opts *SpreadsheetOptions, sinks ...MessageSink) {
 
 	pui.SpreadsheetTotal(total)
 
-	file := excelize.NewFile()
-	streamWriter, err := file.NewStreamWriter("Sheet1")
-	if err != nil {
-		logger.Fatalf("Unable to prepare stream writer: %v", err)
+	if opts.AppendTo != nil {
+		appendMessages(msgs, pui, saveMsgAttachments, saveEml, opts, sinks...)
+		return
 	}
-	styleID, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "#777777"}})
+
+	wb, err := newWorkbook(opts)
 	if err != nil {
-		logger.Fatalf("Unable to prepare header style: %v", err)
+		logger.Fatalf("Unable to prepare xls file: %v", err)
 	}
-	if err := streamWriter.SetRow("A1", []interface{}{
-		excelize.Cell{StyleID: styleID, Value: "FROM"},
-		excelize.Cell{StyleID: styleID, Value: "TO"},
-		excelize.Cell{StyleID: styleID, Value: "SIZE"},
-		excelize.Cell{StyleID: styleID, Value: "DATE"},
-		excelize.Cell{StyleID: styleID, Value: "DATE INTERNAL"},
-		excelize.Cell{StyleID: styleID, Value: "THREAD"},
-		excelize.Cell{StyleID: styleID, Value: "SUBJECT"},
-		excelize.Cell{StyleID: styleID, Value: "SNIPPET"},
-		excelize.Cell{StyleID: styleID, Value: "TEXT BODY"},
-		excelize.Cell{StyleID: styleID, Value: "HTML BODY"},
-		excelize.Cell{StyleID: styleID, Value: "EML"},
-		excelize.Cell{StyleID: styleID, Value: "ATTACHMENT LIST"},
-		excelize.Cell{StyleID: styleID, Value: "ATTACHMENT1"},
-		excelize.Cell{StyleID: styleID, Value: "ATTACHMENT2"},
-		excelize.Cell{StyleID: styleID, Value: "ATTACHMENT3"},
-		excelize.Cell{StyleID: styleID, Value: "ATTACHMENT4"}},
-		excelize.RowOpts{Height: 25, Hidden: false}); err != nil {
-		logger.Fatalf("Cannot write headers to prepare stream, writer: %v", err)
+	var sheet *sheetWriter
+	labelSheets := make(map[string]*sheetWriter)
+	if len(opts.LabelSheets) == 0 {
+		if sheet, err = wb.newSheet("Sheet1"); err != nil {
+			logger.Fatalf("Unable to prepare xls sheet: %v", err)
+		}
 	}
-	err = file.AddTable("Sheet1", "A1", "O1", `{
-		"table_name": "table",
-		"table_style": "TableStyleLight1",
-		"show_first_column": true,
-		"show_last_column": true,
-		"show_row_stripes": true,
-		"show_column_stripes": true
-	}`)
-	if err != nil {
-		logger.Fatalf("Unable to decorate xls table: %v", err)
+	for _, label := range opts.LabelSheets {
+		if labelSheets[label.Id], err = wb.newSheet(label.Name); err != nil {
+			logger.Fatalf("Unable to prepare xls sheet: %v", err)
+		}
 	}
-	// err = file.AutoFilter("Sheet1", "A1", "H1", "")
-	err = file.SetPanes("Sheet1", `{
-		"freeze": true,
-		"split": false,
-		"x_split": 0,
-		"y_split": 1,
-		"top_left_cell": "B2",
-		"active_pane": "topRight",
-		"panes": [
-		{
-			"sqref": "A2",
-			"active_cell": "A2",
-			"pane": "topRight"
-		}]
-	}`)
-	if err != nil {
-		logger.Fatalf("Unable to decorate xls table: %v", err)
+	// messages pulled in by --fetch-threads carry none of the labels: they
+	// go on the sheets of their thread
+	threadSheets := make(map[string][]*sheetWriter)
+	var otherSheet *sheetWriter
+
+	var addresses *sheetWriter
+	if opts.AddressesSheet {
+		if addresses, err = wb.newDataSheet(AddressesSheet, addressesColumns); err != nil {
+			logger.Fatalf("Unable to prepare xls sheet: %v", err)
+		}
+	}
+
+	var stats *analytics
+	if opts.Analytics {
+		stats = newAnalytics(opts.location())
+	}
+
+	var threads *threadView
+	if opts.ThreadView {
+		threads = newThreadView()
 	}
 
-	rowID := 2
 	for msg := range msgs {
-		var attachments []*LocalAttachment = nil
-		var err error = nil
-		if saveMsgAttachments != nil {
-			attachments, err = saveMsgAttachments(msg)
-		}
-		if err != nil {
-			logger.Fatalf("Cannot save attachments: %v", err)
-		}
+		exported := exportMessage(msg, saveMsgAttachments, saveEml)
 
-		var emlFile string = ""
-		if saveEml != nil {
-			emlFile, err = saveEml(msg)
-			if err != nil {
-				logger.Fatalf("Cannot save message: %v", err)
-			}
+		row, err := wb.row(exported)
+		if err != nil {
+			logger.Fatalf("Unable to prepare xls row: %v", err)
 		}
-		// wg.Done()
-		row := make([]interface{}, 50)
-		// go func(msg gmail.Message) {
-
-		for _, h := range msg.Payload.Headers {
-			// fmt.Printf("- %s -", h)
-			if h.Name == "From" {
-				row[0] = h.Value
+		sheets := []*sheetWriter{sheet}
+		if sheet == nil {
+			sheets = sheets[:0]
+			for _, label := range sheetLabels(msg, opts) {
+				sheets = append(sheets, labelSheets[label.Id])
 			}
-			if h.Name == "To" {
-				row[1] = h.Value
-			}
-			if h.Name == "Date" {
-				row[3] = h.Value
+			if len(sheets) > 0 {
+				threadSheets[msg.ThreadId] = sheets
+			} else if sheets = threadSheets[msg.ThreadId]; sheets == nil {
+				// pulled in by a thread not exported so far
+				if otherSheet == nil {
+					if otherSheet, err = wb.newSheet(OtherMessagesSheet); err != nil {
+						logger.Fatalf("Unable to prepare xls sheet: %v", err)
+					}
+				}
+				sheets = []*sheetWriter{otherSheet}
 			}
-			if h.Name == "Subject" {
-				row[6] = h.Value
+		}
+		for _, sheet := range sheets {
+			if err := sheet.writeMessage(exported, row); err != nil {
+				logger.Fatalf("Unable to set xls row: %v", err)
 			}
 		}
-		row[2] = msg.SizeEstimate
-		row[4] = msg.InternalDate
-		row[5] = msg.ThreadId
-		row[7] = msg.Snippet
-		var getBody func(parts []*gmail.MessagePart) (string, string, error)
-		getBody = func(parts []*gmail.MessagePart) (string, string, error) {
-			text := ""
-			html := ""
-			for _, part := range parts {
-				if part.MimeType == "text/plain" {
-					data, _ := base64.StdEncoding.DecodeString(part.Body.Data)
-					text = concat("\n", text, string(data))
-				} else if part.MimeType == "text/html" {
-					data, _ := base64.StdEncoding.DecodeString(part.Body.Data)
-					html = concat("\n", html, string(data))
-				} else if part.Parts != nil {
-					innerText, innerHtml, err := getBody(part.Parts)
-					if err != nil {
-						logger.Fatalf("Unable to process inner part: %v", err)
-					}
-					if innerText != "" {
-						text = concat("\n", text, innerText)
-					}
-					if innerHtml != "" {
-						html = concat("\n", html, innerHtml)
-					}
+		if addresses != nil {
+			for _, addressRow := range addressRows(exported, wb.dateStyle, opts.location()) {
+				if err := addresses.writeRow(addressRow); err != nil {
+					logger.Fatalf("Unable to set xls row: %v", err)
 				}
 			}
-			return text, html, nil
 		}
-
-		textBody, htmlBody, err := getBody(msg.Payload.Parts)
-		if err != nil {
-			logger.Fatalf("Unable to get message body for msg %s: %v", msg.Id, err)
+		if threads != nil {
+			threads.add(exported, row)
 		}
-
-		if !NoTextBody {
-			row[8] = textBody
-		}
-		if !NoHtmlBody {
-			row[9] = htmlBody
+		if stats != nil {
+			stats.add(exported)
 		}
-		row[10] = emlFile
-
-		attachmentCsv := []string{}
-		col := 12
-		for attPos, attachment := range attachments {
-			if attachment != nil {
-				attachmentCsv = append(attachmentCsv, attachment.Filename)
-
-				if attPos < 4 {
-					row[col] = attachment.Filename
-					col++
-				}
+		for _, sink := range sinks {
+			if err := sink.Write(exported); err != nil {
+				logger.Fatalf("Unable to export message %s: %v", msg.Id, err)
 			}
 		}
-		row[11] = strings.Join(attachmentCsv, ",")
-		// }(*msg)
-
-		cell, _ := excelize.CoordinatesToCellName(1, rowID)
-		rowID++
-		if err := streamWriter.SetRow(cell, row); err != nil {
-			logger.Fatalf("Unable to set xls row: %v", err)
-		}
 		pui.SpreadsheetIncrement()
 	}
 
-	if err := streamWriter.Flush(); err != nil {
+	if threads != nil {
+		if err := wb.writeThreads(threads); err != nil {
+			logger.Fatalf("Unable to write threads: %v", err)
+		}
+	}
+	if stats != nil {
+		if err := wb.writeAnalytics(stats); err != nil {
+			logger.Fatalf("Unable to write analytics: %v", err)
+		}
+	}
+	if err := wb.save(); err != nil {
 		logger.Fatalf("Unable to save xls file: %v", err)
 	}
-
-	return file
 }
@@ -0,0 +1,181 @@
+package svc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Ways attachments reference the content store from the message folders.
+const (
+	// Messages reference the stored files directly
+	StoreLinkNone = "none"
+	// Hard links within the message folders
+	StoreLinkHard = "hardlink"
+	// Symbolic links within the message folders
+	StoreLinkSymbolic = "symlink"
+)
+
+type storedObject struct {
+	hash string
+	path string
+	size int64
+	// content of objects saved from inline parts, kept for embedding them
+	data []byte
+	// text extracted once, shared by the attachments reusing the object
+	extract     sync.Once
+	textExcerpt string
+	textFile    string
+}
+
+// ContentStore saves attachments once by SHA-256 of their content, reusing
+// earlier downloads of the same attachments.
+type ContentStore struct {
+	Dir  string
+	Link string
+	// Also reuse downloads of attachments with the same name, type and size
+	ReuseBySize bool
+	// Bytes not written thanks to deduplication
+	SavedBytes int64
+	// Downloads avoided by reusing earlier ones
+	ReusedDownloads int
+
+	byAttachmentId map[string]*storedObject
+	byFingerprint  map[string]*storedObject
+	byHash         map[string]*storedObject
+	mutex          sync.Mutex
+}
+
+func NewContentStore(dir string, link string, reuseBySize bool) *ContentStore {
+	return &ContentStore{
+		Dir:            dir,
+		Link:           link,
+		ReuseBySize:    reuseBySize,
+		byAttachmentId: make(map[string]*storedObject),
+		byFingerprint:  make(map[string]*storedObject),
+		byHash:         make(map[string]*storedObject),
+	}
+}
+
+func partFingerprint(part *gmail.MessagePart, filename string) string {
+	if part.Body == nil || part.Body.Size == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s\x00%s\x00%d", filename, strings.ToLower(part.MimeType), part.Body.Size)
+}
+
+// Returns the stored object for an attachment downloaded before, if any.
+func (s *ContentStore) lookup(part *gmail.MessagePart, filename string) *storedObject {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var obj *storedObject
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		obj = s.byAttachmentId[part.Body.AttachmentId]
+	}
+	if obj == nil && s.ReuseBySize {
+		obj = s.byFingerprint[partFingerprint(part, filename)]
+	}
+	if obj != nil {
+		s.ReusedDownloads++
+		s.SavedBytes += obj.size
+	}
+	return obj
+}
+
+// Stores the content of an attachment, unless already stored.
+func (s *ContentStore) put(out Output, part *gmail.MessagePart, filename string, data []byte) (*storedObject, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.byHash[hash]
+	if ok {
+		s.SavedBytes += obj.size
+	} else {
+		// keeps the extension, so that stored files open with the right application
+		ext := strings.ToLower(filepath.Ext(SanitizeFilename(filename)))
+		path := filepath.Join(s.Dir, hash[:2], hash+ext)
+		obj = &storedObject{hash: hash, path: path, size: int64(len(data))}
+		if info, err := os.Stat(path); err != nil || info.Size() != obj.size || !isDirOutput(out) {
+			if err := out.WriteFile(path, data, time.Time{}); err != nil {
+				return nil, err
+			}
+		} else {
+			// stored by a previous export
+			s.SavedBytes += obj.size
+		}
+		s.byHash[hash] = obj
+	}
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		s.byAttachmentId[part.Body.AttachmentId] = obj
+	}
+	if fingerprint := partFingerprint(part, filename); fingerprint != "" {
+		s.byFingerprint[fingerprint] = obj
+	}
+	return obj, nil
+}
+
+// Returns the content of an object saved from an inline part, retrieving it
+// through fetch when the object has been stored from a regular attachment.
+func (s *ContentStore) inlineData(obj *storedObject, fetch func() ([]byte, error)) ([]byte, error) {
+	s.mutex.Lock()
+	data := obj.data
+	s.mutex.Unlock()
+	if data != nil {
+		return data, nil
+	}
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj.data = data
+	return data, nil
+}
+
+// Extracts the text of a stored object once, writing the sidecar file next
+// to it. Attachments reusing the object get the same text.
+func (s *ContentStore) extractText(out Output, e *TextExtractor, obj *storedObject, attachment *LocalAttachment, data []byte) {
+	obj.extract.Do(func() {
+		stored := *attachment
+		stored.Filename = out.Path(obj.path)
+		e.process(out, &stored, data)
+		obj.textExcerpt, obj.textFile = stored.TextExcerpt, stored.TextFile
+	})
+	attachment.TextExcerpt, attachment.TextFile = obj.textExcerpt, obj.textFile
+}
+
+// Links a stored object from a message folder.
+func (s *ContentStore) link(obj *storedObject, linkPath string) error {
+	os.Remove(linkPath)
+	switch s.Link {
+	case StoreLinkHard:
+		return os.Link(obj.path, linkPath)
+	case StoreLinkSymbolic:
+		target, err := filepath.Rel(filepath.Dir(linkPath), obj.path)
+		if err != nil {
+			target, _ = filepath.Abs(obj.path)
+		}
+		return os.Symlink(target, linkPath)
+	}
+	return nil
+}
+
+// Returns whether files are written to the local filesystem, looking through
+// the outputs wrapping others.
+func isDirOutput(out Output) bool {
+	if wrapper, ok := out.(interface{ Unwrap() Output }); ok {
+		return isDirOutput(wrapper.Unwrap())
+	}
+	_, ok := out.(*DirOutput)
+	return ok
+}
@@ -0,0 +1,129 @@
+package svc
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func testAttachmentPart(partId string, attachmentId string, filename string, content string) *gmail.MessagePart {
+	return &gmail.MessagePart{
+		PartId:   partId,
+		MimeType: "application/pdf",
+		Filename: filename,
+		Body: &gmail.MessagePartBody{
+			AttachmentId: attachmentId,
+			Size:         int64(len(content)),
+			Data:         base64.URLEncoding.EncodeToString([]byte(content)),
+		},
+	}
+}
+
+func TestContentStoreDedup(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		reuseBySize bool
+		parts       []*gmail.MessagePart
+		stored      int
+		reused      int
+		savedBytes  int64
+	}{
+		{"same attachment", false, []*gmail.MessagePart{
+			testAttachmentPart("1", "att1", "a.pdf", "%PDF-1"),
+			testAttachmentPart("1", "att1", "a.pdf", "%PDF-1"),
+		}, 1, 1, 6},
+		{"same content", false, []*gmail.MessagePart{
+			testAttachmentPart("1", "att1", "a.pdf", "%PDF-1"),
+			testAttachmentPart("1", "att2", "b.pdf", "%PDF-1"),
+		}, 1, 0, 6},
+		{"different content", false, []*gmail.MessagePart{
+			testAttachmentPart("1", "att1", "a.pdf", "%PDF-1"),
+			testAttachmentPart("1", "att2", "a.pdf", "%PDF-2"),
+		}, 2, 0, 0},
+		{"same name and size", true, []*gmail.MessagePart{
+			testAttachmentPart("1", "att1", "a.pdf", "%PDF-1"),
+			testAttachmentPart("1", "att2", "a.pdf", "%PDF-2"),
+		}, 1, 1, 6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &AttachmentOptions{
+				Names: NewUniqueFilenames(CollisionCounter),
+				Store: NewContentStore(filepath.Join(dir, "store"), StoreLinkNone, test.reuseBySize),
+			}
+			for i, p := range test.parts {
+				msgDir := filepath.Join(dir, "messages", string(rune('a'+i)))
+				attachment, err := storeAttachment(nil, nil, &DirOutput{}, opts, "me", "m1", msgDir, p, p.Filename, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if filepath.Dir(filepath.Dir(attachment.Filename)) != opts.Store.Dir {
+					t.Errorf("expected a stored file, got %s", attachment.Filename)
+				}
+			}
+			stored := 0
+			filepath.Walk(opts.Store.Dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					stored++
+				}
+				return nil
+			})
+			if stored != test.stored || opts.Store.ReusedDownloads != test.reused || opts.Store.SavedBytes != test.savedBytes {
+				t.Errorf("expected %d stored, %d reused, %d bytes saved, got %d, %d, %d",
+					test.stored, test.reused, test.savedBytes, stored, opts.Store.ReusedDownloads, opts.Store.SavedBytes)
+			}
+		})
+	}
+}
+
+func TestContentStoreLink(t *testing.T) {
+	for _, link := range []string{StoreLinkHard, StoreLinkSymbolic} {
+		t.Run(link, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &AttachmentOptions{
+				Names: NewUniqueFilenames(CollisionHash),
+				Store: NewContentStore(filepath.Join(dir, "store"), link, false),
+			}
+			msgDir := filepath.Join(dir, "messages", "m1")
+			paths := make([]string, 0)
+			for _, p := range []*gmail.MessagePart{
+				testAttachmentPart("1", "att1", "report.pdf", "%PDF-1"),
+				testAttachmentPart("2", "att2", "report.pdf", "%PDF-2"),
+				// reused, linked under the name of the same content
+				testAttachmentPart("3", "att1", "report.pdf", "%PDF-1"),
+			} {
+				attachment, err := storeAttachment(nil, nil, &DirOutput{}, opts, "me", "m1", msgDir, p, p.Filename, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, attachment.Filename)
+			}
+			// named after the content digest, as with the plain hash strategy
+			names := NewUniqueFilenames(CollisionHash)
+			for i, content := range []string{"%PDF-1", "%PDF-2", "%PDF-1"} {
+				if want := names.Unique(msgDir, "report.pdf", "", []byte(content)); paths[i] != want {
+					t.Errorf("#%d: expected %s, got %s", i, want, paths[i])
+				}
+				data, err := os.ReadFile(paths[i])
+				if err != nil || string(data) != content {
+					t.Errorf("#%d: expected %q, got %q (%v)", i, content, data, err)
+				}
+			}
+			info, err := os.Lstat(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if symlink := info.Mode()&os.ModeSymlink != 0; symlink != (link == StoreLinkSymbolic) {
+				t.Errorf("unexpected file mode %v", info.Mode())
+			}
+			if link == StoreLinkSymbolic {
+				if target, _ := os.Readlink(paths[0]); filepath.IsAbs(target) {
+					t.Errorf("expected a relative link, got %s", target)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Name of the front sheet summarizing the label sheets.
+const SummarySheet = "Summary"
+
+// Name of the sheet of the messages carrying none of the labels written on
+// sheets of their own, nor sharing a thread with messages carrying them.
+const OtherMessagesSheet = "Other messages"
+
+// Policies for messages carrying several of the labels written on sheets of
+// their own.
+const (
+	// Write the message on the sheet of every label it carries
+	LabelDedupAll = "all"
+	// Write the message only on the sheet of the first requested label
+	LabelDedupFirst = "first"
+)
+
+// Totals of the messages written to a sheet.
+type sheetStats struct {
+	Messages    int
+	Size        int64
+	First       time.Time
+	Last        time.Time
+	Attachments int
+}
+
+func (s *sheetStats) add(msg *ExportedMessage) {
+	s.Messages++
+	s.Size += msg.SizeEstimate
+	received := time.UnixMilli(msg.InternalDate)
+	if s.First.IsZero() || received.Before(s.First) {
+		s.First = received
+	}
+	if received.After(s.Last) {
+		s.Last = received
+	}
+	s.Attachments += len(SavedAttachments(msg.Attachments))
+}
+
+func (wb *workbook) summary() bool {
+	return len(wb.opts.LabelSheets) > 0
+}
+
+// Returns the labels, among the ones written on sheets of their own, whose
+// sheets should contain the message.
+func sheetLabels(msg *gmail.Message, opts *SpreadsheetOptions) []*gmail.Label {
+	ret := make([]*gmail.Label, 0)
+	for _, label := range opts.LabelSheets {
+		for _, labelId := range msg.LabelIds {
+			if labelId == label.Id {
+				ret = append(ret, label)
+				break
+			}
+		}
+		if len(ret) > 0 && opts.LabelDedup == LabelDedupFirst {
+			break
+		}
+	}
+	return ret
+}
+
+// Writes the summary sheet: a row of totals for every label sheet, linking
+// it, and a row of totals for the whole workbook.
+func (wb *workbook) writeSummary() error {
+	file := wb.file
+	headerStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	dateStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &dateTimeFormat})
+	if err != nil {
+		return err
+	}
+	sizeStyle, err := file.NewStyle(&excelize.Style{CustomNumFmt: &sizeFormat})
+	if err != nil {
+		return err
+	}
+	linkStyle, err := file.NewStyle(hyperlinkStyle)
+	if err != nil {
+		return err
+	}
+
+	if err := file.SetSheetRow(SummarySheet, "A1", &[]interface{}{
+		"LABEL", "MESSAGES", "SIZE", "FIRST DATE", "LAST DATE", "ATTACHMENTS",
+	}); err != nil {
+		return err
+	}
+	if err := file.SetCellStyle(SummarySheet, "A1", "F1", headerStyle); err != nil {
+		return err
+	}
+	setStats := func(rowID int, label string, stats *sheetStats) error {
+		row := []interface{}{label, stats.Messages, stats.Size, nil, nil, stats.Attachments}
+		if stats.Messages > 0 {
+			row[3] = stats.First.In(wb.opts.location())
+			row[4] = stats.Last.In(wb.opts.location())
+		}
+		if err := file.SetSheetRow(SummarySheet, fmt.Sprintf("A%d", rowID), &row); err != nil {
+			return err
+		}
+		if err := file.SetCellStyle(SummarySheet, fmt.Sprintf("C%d", rowID), fmt.Sprintf("C%d", rowID), sizeStyle); err != nil {
+			return err
+		}
+		return file.SetCellStyle(SummarySheet, fmt.Sprintf("D%d", rowID), fmt.Sprintf("E%d", rowID), dateStyle)
+	}
+
+	rowID := 2
+	for _, sw := range wb.sheets {
+		if sw.columns != nil {
+			continue
+		}
+		if err := setStats(rowID, sw.title, &sw.stats); err != nil {
+			return err
+		}
+		cell := fmt.Sprintf("A%d", rowID)
+		// links the first sheet of the label
+		location := fmt.Sprintf("'%s'!A1", strings.ReplaceAll(sheetName(sw.base, 1), "'", "''"))
+		if err := file.SetCellHyperLink(SummarySheet, cell, location, "Location"); err != nil {
+			return err
+		}
+		if err := file.SetCellStyle(SummarySheet, cell, cell, linkStyle); err != nil {
+			return err
+		}
+		rowID++
+	}
+	// messages carrying several labels are counted once
+	if err := setStats(rowID, "TOTAL", &wb.total); err != nil {
+		return err
+	}
+	if err := file.SetCellStyle(SummarySheet, fmt.Sprintf("A%d", rowID), fmt.Sprintf("A%d", rowID), headerStyle); err != nil {
+		return err
+	}
+
+	if err := file.SetColWidth(SummarySheet, "A", "A", 30); err != nil {
+		return err
+	}
+	return file.SetColWidth(SummarySheet, "B", "F", 18)
+}
@@ -0,0 +1,85 @@
+package svc
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestSheetLabels(t *testing.T) {
+	work := &gmail.Label{Id: "Label_1", Name: "Work"}
+	home := &gmail.Label{Id: "Label_2", Name: "Home"}
+	for _, test := range []struct {
+		labelIds []string
+		dedup    string
+		want     []*gmail.Label
+	}{
+		{[]string{"INBOX"}, "", []*gmail.Label{}},
+		{[]string{"Label_2", "Label_1"}, "", []*gmail.Label{work, home}},
+		{[]string{"Label_2", "Label_1"}, LabelDedupAll, []*gmail.Label{work, home}},
+		{[]string{"Label_2", "Label_1"}, LabelDedupFirst, []*gmail.Label{work}},
+		{[]string{"Label_2"}, LabelDedupFirst, []*gmail.Label{home}},
+	} {
+		opts := &SpreadsheetOptions{LabelSheets: []*gmail.Label{work, home}, LabelDedup: test.dedup}
+		if got := sheetLabels(&gmail.Message{LabelIds: test.labelIds}, opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v %s: expected %v, got %v", test.labelIds, test.dedup, test.want, got)
+		}
+	}
+}
+
+func TestLabelSheets(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject"})
+	msg := func(id, threadId string, size int64, labelIds ...string) *gmail.Message {
+		return &gmail.Message{Id: id, ThreadId: threadId, SizeEstimate: size, LabelIds: labelIds, Payload: &gmail.MessagePart{}}
+	}
+	msgs := []*gmail.Message{
+		msg("m1", "t1", 100, "Label_1"),
+		msg("m2", "t2", 200, "Label_1", "Label_2"),
+		// pulled in by the thread of m1
+		msg("m3", "t1", 300),
+		// pulled in by a thread not exported
+		msg("m4", "t4", 400),
+	}
+	for _, test := range []struct {
+		dedup string
+		want  map[string][]string
+		// label and message count of every summary row
+		summary [][]string
+	}{
+		{LabelDedupAll,
+			map[string][]string{"Work": {"m1", "m2", "m3"}, "Home": {"m2"}, OtherMessagesSheet: {"m4"}},
+			[][]string{{"Work", "3"}, {"Home", "1"}, {OtherMessagesSheet, "1"}, {"TOTAL", "4"}}},
+		{LabelDedupFirst,
+			map[string][]string{"Work": {"m1", "m2", "m3"}, "Home": {}, OtherMessagesSheet: {"m4"}},
+			[][]string{{"Work", "3"}, {"Home", "0"}, {OtherMessagesSheet, "1"}, {"TOTAL", "4"}}},
+	} {
+		opts := &SpreadsheetOptions{
+			Columns:     columns,
+			LabelSheets: []*gmail.Label{{Id: "Label_1", Name: "Work"}, {Id: "Label_2", Name: "Home"}},
+			LabelDedup:  test.dedup,
+		}
+		file := testWorkbooks(t, opts, msgs...)[0]
+		if sheets := file.GetSheetList(); sheets[0] != SummarySheet {
+			t.Errorf("%s: expected the summary first, got %v", test.dedup, sheets)
+		}
+		rows, err := file.GetRows(SummarySheet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary := make([][]string, 0)
+		for _, row := range rows[1:] {
+			summary = append(summary, row[:2])
+		}
+		if !reflect.DeepEqual(summary, test.summary) {
+			t.Errorf("%s: expected the summary %v, got %v", test.dedup, test.summary, summary)
+		}
+		if link, target, _ := file.GetCellHyperLink(SummarySheet, "A2"); !link || target != "'Work'!A1" {
+			t.Errorf("%s: expected a link to the sheet, got %s", test.dedup, target)
+		}
+		file.DeleteSheet(SummarySheet)
+		if ids := sheetIds(t, file); !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.dedup, test.want, ids)
+		}
+	}
+}
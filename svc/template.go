@@ -0,0 +1,262 @@
+package svc
+
+import (
+	"bufio"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateMessage is the data model exposed to the templates, for every
+// exported message.
+type TemplateMessage struct {
+	// Position of the message within the report, starting from 1
+	Index    int
+	Id       string
+	ThreadId string
+	// Date header, falling back on InternalDate when missing or malformed
+	Date         time.Time
+	InternalDate time.Time
+	Size         int64
+	From         *mail.Address
+	To           []*mail.Address
+	Cc           []*mail.Address
+	Bcc          []*mail.Address
+	ReplyTo      []*mail.Address
+	Subject      string
+	Snippet      string
+	TextBody     string
+	HtmlBody     string
+	LabelIds     []string
+	Labels       []string
+	Eml          string
+	Attachments  []string
+	// All the message headers, by canonical name
+	Headers mail.Header
+}
+
+// TemplateReport is the data model exposed to header and footer templates.
+type TemplateReport struct {
+	Generated time.Time
+	// Messages written so far: always 0 for the header
+	Count     int
+	TotalSize int64
+}
+
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+var templateFuncs = map[string]interface{}{
+	// formats a time using a go layout, i.e. {{ date "2006-01-02" .Date }}
+	"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	// formats a time in the given IANA zone, i.e. {{ dateIn "Europe/Rome" "15:04" .Date }}
+	"dateIn": func(zone string, layout string, t time.Time) (string, error) {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return "", err
+		}
+		return t.In(loc).Format(layout), nil
+	},
+	// formats an address as 'Name <email>'
+	"address": formatAddress,
+	// formats a list of addresses, comma separated
+	"addresses": func(addresses []*mail.Address) string {
+		formatted := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			formatted = append(formatted, formatAddress(address))
+		}
+		return strings.Join(formatted, ", ")
+	},
+	// returns the emails of a list of addresses, comma separated
+	"emails": func(addresses []*mail.Address) string {
+		emails := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			if address != nil && address.Address != "" {
+				emails = append(emails, address.Address)
+			}
+		}
+		return strings.Join(emails, ", ")
+	},
+	// returns the display name of an address, falling back on its email
+	"name": func(address *mail.Address) string {
+		if address == nil {
+			return ""
+		}
+		if address.Name != "" {
+			return address.Name
+		}
+		return address.Address
+	},
+	// returns the domain of an address
+	"domain": func(address *mail.Address) string {
+		if address == nil {
+			return ""
+		}
+		return EmailDomain(address.Address)
+	},
+	// formats a size in bytes as a human readable string, i.e. 1.5 MB
+	"bytes": HumanBytes,
+	// joins a list, with the separator first so that it works in pipelines
+	"join": func(sep string, list []string) string {
+		return strings.Join(list, sep)
+	},
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"truncate": truncate,
+	// quotes a CSV field
+	"csv": func(s string) string {
+		if strings.ContainsAny(s, "\",\r\n") {
+			return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+		}
+		return s
+	},
+	// escapes LaTeX special chars
+	"latex": strings.NewReplacer(
+		`\`, `\textbackslash{}`, `{`, `\{`, `}`, `\}`, `$`, `\$`, `&`, `\&`, `#`, `\#`,
+		`%`, `\%`, `_`, `\_`, `^`, `\textasciicircum{}`, `~`, `\textasciitilde{}`,
+	).Replace,
+}
+
+func formatAddress(address *mail.Address) string {
+	if address == nil {
+		return ""
+	}
+	if address.Name == "" {
+		return address.Address
+	}
+	if address.Address == "" {
+		return address.Name
+	}
+	return address.Name + " <" + address.Address + ">"
+}
+
+// Returns at most n runes of s, marking the truncation with an ellipsis.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
+
+// Parses an optional template file, as html/template when Html is true.
+func parseTemplate(filename string, html bool) (templateExecutor, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(filename)
+	if html {
+		return htmltemplate.New(name).Funcs(templateFuncs).Parse(string(content))
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(string(content))
+}
+
+// TemplateOutput renders every exported message through a user supplied
+// template, with optional header and footer templates.
+type TemplateOutput struct {
+	labelNames map[string]string
+	file       io.WriteCloser
+	out        *bufio.Writer
+	message    templateExecutor
+	header     templateExecutor
+	footer     templateExecutor
+	report     TemplateReport
+}
+
+func NewTemplateOutput(out Output, filename string, messageTemplate string, headerTemplate string, footerTemplate string, html bool, labelNames map[string]string) (*TemplateOutput, error) {
+	t := &TemplateOutput{labelNames: labelNames, report: TemplateReport{Generated: time.Now()}}
+	var err error
+	if t.message, err = parseTemplate(messageTemplate, html); err != nil {
+		return nil, err
+	}
+	if t.header, err = parseTemplate(headerTemplate, html); err != nil {
+		return nil, err
+	}
+	if t.footer, err = parseTemplate(footerTemplate, html); err != nil {
+		return nil, err
+	}
+	if t.file, err = out.Create(filename); err != nil {
+		return nil, err
+	}
+	t.out = bufio.NewWriter(t.file)
+	if t.header != nil {
+		if err := t.header.Execute(t.out, t.report); err != nil {
+			t.file.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Returns the template data model for a message.
+func NewTemplateMessage(msg *ExportedMessage, labelNames map[string]string) *TemplateMessage {
+	data := &TemplateMessage{
+		Id:           msg.Id,
+		ThreadId:     msg.ThreadId,
+		InternalDate: time.UnixMilli(msg.InternalDate),
+		Size:         msg.SizeEstimate,
+		To:           ParseAddressList(GetHeader(msg.Message, "To")),
+		Cc:           ParseAddressList(GetHeader(msg.Message, "Cc")),
+		Bcc:          ParseAddressList(GetHeader(msg.Message, "Bcc")),
+		ReplyTo:      ParseAddressList(GetHeader(msg.Message, "Reply-To")),
+		Subject:      DecodeHeader(GetHeader(msg.Message, "Subject")),
+		Snippet:      msg.Snippet,
+		TextBody:     msg.TextBody,
+		HtmlBody:     msg.HtmlBody,
+		LabelIds:     msg.LabelIds,
+		Labels:       GetLabelNamesOf(labelNames, msg.LabelIds),
+		Eml:          msg.Eml,
+		Headers:      make(mail.Header),
+	}
+	data.Date = ParseDateHeader(GetHeader(msg.Message, "Date"))
+	if data.Date.IsZero() {
+		data.Date = data.InternalDate
+	}
+	if from := ParseAddressList(GetHeader(msg.Message, "From")); len(from) > 0 {
+		data.From = from[0]
+	}
+	for _, attachment := range SavedAttachments(msg.Attachments) {
+		data.Attachments = append(data.Attachments, attachment.Filename)
+	}
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			key := textproto.CanonicalMIMEHeaderKey(h.Name)
+			data.Headers[key] = append(data.Headers[key], h.Value)
+		}
+	}
+	return data
+}
+
+func (t *TemplateOutput) Write(msg *ExportedMessage) error {
+	t.report.Count++
+	t.report.TotalSize += msg.SizeEstimate
+	data := NewTemplateMessage(msg, t.labelNames)
+	data.Index = t.report.Count
+	return t.message.Execute(t.out, data)
+}
+
+func (t *TemplateOutput) Close() error {
+	if t.footer != nil {
+		if err := t.footer.Execute(t.out, t.report); err != nil {
+			t.file.Close()
+			return err
+		}
+	}
+	if err := t.out.Flush(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
@@ -0,0 +1,133 @@
+package svc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func testTemplateMessage(id string) *ExportedMessage {
+	return &ExportedMessage{
+		Message: &gmail.Message{
+			Id:           id,
+			ThreadId:     "t1",
+			InternalDate: time.Date(2023, 1, 31, 23, 30, 0, 0, time.UTC).UnixMilli(),
+			SizeEstimate: 1536,
+			LabelIds:     []string{"INBOX", "Label_1"},
+			Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "Jane Doe <jane@Example.com>"},
+				{Name: "To", Value: "a@example.com, Bob <b@example.org>"},
+				{Name: "Subject", Value: "100% \"done\", {ok}"},
+				{Name: "x-mailer", Value: "test"},
+			}},
+		},
+		TextBody:    "body",
+		Attachments: []*LocalAttachment{{Filename: "att/a.pdf"}, {Filename: "att/b.png", Skipped: "filtered"}},
+	}
+}
+
+// Renders the message template text for a message.
+func testRender(t *testing.T, text string, html bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "message.tmpl")
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "report.txt")
+	tmpl, err := NewTemplateOutput(&DirOutput{}, output, filename, "", "", html, map[string]string{"INBOX": "INBOX", "Label_1": "Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Write(testTemplateMessage("m1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want string
+	}{
+		{`{{ .Index }} {{ .Id }} {{ .ThreadId }}`, "1 m1 t1"},
+		{`{{ date "2006-01-02 15:04" .Date }}`, "2023-01-31 23:30"},
+		{`{{ dateIn "Europe/Rome" "2006-01-02" .Date }}`, "2023-02-01"},
+		{`{{ address .From }}|{{ name .From }}|{{ domain .From }}`, "Jane Doe <jane@Example.com>|Jane Doe|example.com"},
+		{`{{ addresses .To }}|{{ emails .To }}`, "a@example.com, Bob <b@example.org>|a@example.com, b@example.org"},
+		{`{{ name (index .To 0) }}`, "a@example.com"},
+		{`{{ bytes .Size }}`, "1.5 KB"},
+		{`{{ .Labels | join "/" }}`, "INBOX/Work"},
+		{`{{ join ", " .Attachments }}`, "att/a.pdf"},
+		{`{{ upper .Id }}{{ lower "AB" }}{{ trim "  x " }}`, "M1abx"},
+		{`{{ truncate 3 "àèìòù" }}`, "àèì…"},
+		{`{{ csv .Subject }}`, `"100% ""done"", {ok}"`},
+		{`{{ latex .Subject }}`, `100\% "done", \{ok\}`},
+		{`{{ index .Headers "X-Mailer" }}`, "[test]"},
+	} {
+		if got := testRender(t, test.text, false); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.text, test.want, got)
+		}
+	}
+}
+
+func TestTemplateHtml(t *testing.T) {
+	if got := testRender(t, `<p>{{ .Subject }}</p>`, true); got != `<p>100% &#34;done&#34;, {ok}</p>` {
+		t.Errorf("expected escaped html, got %s", got)
+	}
+}
+
+func TestTemplateReport(t *testing.T) {
+	dir := t.TempDir()
+	templates := map[string]string{
+		"message.tmpl": "{{ .Id }}\n",
+		"header.tmpl":  "count {{ .Count }}\n",
+		"footer.tmpl":  "count {{ .Count }}, {{ bytes .TotalSize }}\n",
+	}
+	for name, text := range templates {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := filepath.Join(dir, "report.txt")
+	tmpl, err := NewTemplateOutput(&DirOutput{}, output,
+		filepath.Join(dir, "message.tmpl"), filepath.Join(dir, "header.tmpl"), filepath.Join(dir, "footer.tmpl"), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if err := tmpl.Write(testTemplateMessage(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tmpl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(output)
+	if want := "count 0\nm1\nm2\ncount 2, 3.0 KB\n"; string(data) != want {
+		t.Errorf("expected %q, got %q", want, data)
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "message.tmpl")
+	os.WriteFile(filename, []byte("{{ .Id "), 0644)
+	if _, err := NewTemplateOutput(&DirOutput{}, filepath.Join(dir, "out"), filename, "", "", false, nil); err == nil {
+		t.Error("expected a parse error")
+	}
+	if _, err := NewTemplateOutput(&DirOutput{}, filepath.Join(dir, "out"), filepath.Join(dir, "missing.tmpl"), "", "", false, nil); err == nil || !strings.Contains(err.Error(), "missing.tmpl") {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
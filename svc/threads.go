@@ -0,0 +1,232 @@
+package svc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidecavestro/gmail-exporter/logger"
+	"github.com/davidecavestro/gmail-exporter/ui"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/ratelimit"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Name of the sheet grouping messages by thread.
+const ThreadsSheet = "Threads"
+
+// Leading columns of the threads sheet, filled on thread header rows.
+var threadColumns = []string{"THREAD ID", "MESSAGES", "PARTICIPANTS", "FIRST DATE", "LAST DATE"}
+
+type threadMessage struct {
+	received time.Time
+	row      []interface{}
+}
+
+type thread struct {
+	id           string
+	messages     []*threadMessage
+	participants []string
+	seen         map[string]bool
+}
+
+// threadView collects the exported rows, to write them grouped by thread once
+// all the messages are known.
+type threadView struct {
+	threads []*thread
+	byId    map[string]*thread
+}
+
+func newThreadView() *threadView {
+	return &threadView{byId: make(map[string]*thread)}
+}
+
+func (tv *threadView) add(msg *ExportedMessage, row []interface{}) {
+	t, ok := tv.byId[msg.ThreadId]
+	if !ok {
+		t = &thread{id: msg.ThreadId, seen: make(map[string]bool)}
+		tv.byId[msg.ThreadId] = t
+		tv.threads = append(tv.threads, t)
+	}
+	t.messages = append(t.messages, &threadMessage{received: time.UnixMilli(msg.InternalDate), row: row})
+	for _, header := range []string{"From", "To", "Cc"} {
+		for _, address := range ParseAddressList(GetHeader(msg.Message, header)) {
+			email := strings.ToLower(address.Address)
+			if email != "" && !t.seen[email] {
+				t.seen[email] = true
+				t.participants = append(t.participants, email)
+			}
+		}
+	}
+}
+
+func (t *thread) first() time.Time {
+	return t.messages[0].received
+}
+
+func (t *thread) last() time.Time {
+	return t.messages[len(t.messages)-1].received
+}
+
+// Writes the threads sheet: a header row for every thread, followed by its
+// messages grouped as collapsible rows. Rows are written through the non
+// streaming API, as the stream writer does not support outline levels.
+func (wb *workbook) writeThreads(tv *threadView) error {
+	for _, t := range tv.threads {
+		sort.SliceStable(t.messages, func(i, j int) bool { return t.messages[i].received.Before(t.messages[j].received) })
+	}
+	sort.SliceStable(tv.threads, func(i, j int) bool { return tv.threads[i].first().Before(tv.threads[j].first()) })
+
+	file := wb.file
+	boldStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	dateStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}, CustomNumFmt: &dateTimeFormat})
+	if err != nil {
+		return err
+	}
+
+	part := 0
+	name := ""
+	rowID := 0
+	openSheet := func() error {
+		part++
+		name = sheetName(ThreadsSheet, part)
+		for n := 2; file.GetSheetIndex(name) >= 0; n++ {
+			name = sheetName(fmt.Sprintf("%s %d", ThreadsSheet, n), part)
+		}
+		file.NewSheet(name)
+		headers := make([]interface{}, 0, len(threadColumns)+len(wb.layout))
+		for _, title := range threadColumns {
+			headers = append(headers, excelize.Cell{StyleID: wb.headerStyle, Value: title})
+		}
+		for _, col := range wb.layout {
+			headers = append(headers, excelize.Cell{StyleID: wb.headerStyle, Value: col.title()})
+		}
+		if err := setSheetCells(file, name, 1, headers); err != nil {
+			return err
+		}
+		rowID = 2
+		// thread header rows stay above their messages
+		if err := file.SetSheetPrOptions(name, excelize.OutlineSummaryBelow(false)); err != nil {
+			return err
+		}
+		return file.SetPanes(name, `{"freeze": true, "split": false, "x_split": 0, "y_split": 1, "top_left_cell": "A2", "active_pane": "bottomLeft"}`)
+	}
+	if err := openSheet(); err != nil {
+		return err
+	}
+
+	leading := make([]interface{}, len(threadColumns))
+	for _, t := range tv.threads {
+		// keeps threads on a single sheet, unless longer than a whole one
+		if rowID > 2 && rowID+len(t.messages) > wb.maxRows() {
+			if err := openSheet(); err != nil {
+				return err
+			}
+		}
+		header := []interface{}{
+			excelize.Cell{StyleID: boldStyle, Value: t.id},
+			excelize.Cell{StyleID: boldStyle, Value: len(t.messages)},
+			excelize.Cell{StyleID: boldStyle, Value: truncateCell(strings.Join(t.participants, ", "))},
+			excelize.Cell{StyleID: dateStyle, Value: t.first().In(wb.opts.location())},
+			excelize.Cell{StyleID: dateStyle, Value: t.last().In(wb.opts.location())},
+		}
+		if err := setSheetCells(file, name, rowID, header); err != nil {
+			return err
+		}
+		rowID++
+		for _, msg := range t.messages {
+			if rowID > wb.maxRows() {
+				if err := openSheet(); err != nil {
+					return err
+				}
+			}
+			if err := setSheetCells(file, name, rowID, append(leading, msg.row...)); err != nil {
+				return err
+			}
+			if err := file.SetRowOutlineLevel(name, rowID, 1); err != nil {
+				return err
+			}
+			rowID++
+		}
+	}
+	return nil
+}
+
+// Sets the cells of a row through the non streaming API, supporting the
+// same values of the stream writer.
+func setSheetCells(file *excelize.File, sheet string, rowID int, values []interface{}) error {
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		axis, _ := excelize.CoordinatesToCellName(i+1, rowID)
+		if cell, ok := value.(excelize.Cell); ok {
+			if cell.Value != nil {
+				if err := file.SetCellValue(sheet, axis, cell.Value); err != nil {
+					return err
+				}
+			}
+			if cell.Formula != "" {
+				if err := file.SetCellFormula(sheet, axis, cell.Formula); err != nil {
+					return err
+				}
+			}
+			if cell.StyleID != 0 {
+				if err := file.SetCellStyle(sheet, axis, axis, cell.StyleID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := file.SetCellValue(sheet, axis, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the whole threads of the messages, even messages not matching the
+// export filters. Messages are returned once, the one pulling in a thread
+// ahead of the rest of it. Added messages are fetched following the plan and
+// accounted to the progress.
+func ExpandThreads(srv *gmail.Service, rateLimiter ratelimit.Limiter, pui *ui.ProgressUI, user string, plan string, msgs chan *gmail.Message) chan *gmail.Message {
+	ret := make(chan *gmail.Message, cap(msgs))
+	go func() {
+		defer close(ret)
+		threads := make(map[string]bool)
+		seen := make(map[string]bool)
+		for msg := range msgs {
+			if seen[msg.Id] {
+				// already exported along with its thread
+				pui.SpreadsheetAddTotal(-1)
+				continue
+			}
+			seen[msg.Id] = true
+			ret <- msg
+			if threads[msg.ThreadId] {
+				continue
+			}
+			threads[msg.ThreadId] = true
+			if rateLimiter != nil {
+				rateLimiter.Take()
+			}
+			// just the ids, messages are then fetched as the listed ones
+			thread, err := srv.Users.Threads.Get(user, msg.ThreadId).Format("minimal").Do()
+			if err != nil {
+				logger.Fatalf("Unable to retrieve %s thread: %v", msg.ThreadId, err)
+			}
+			for _, threadMsg := range thread.Messages {
+				if !seen[threadMsg.Id] {
+					seen[threadMsg.Id] = true
+					pui.SpreadsheetAddTotal(1)
+					ret <- fetchMessage(srv, rateLimiter, user, threadMsg.Id, plan)
+				}
+			}
+		}
+	}()
+	return ret
+}
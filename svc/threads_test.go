@@ -0,0 +1,111 @@
+package svc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Returns a message of a thread, received the given minutes after a fixed
+// date.
+func testThreadMessage(id, threadId string, minutes int, from, to string) *gmail.Message {
+	return &gmail.Message{
+		Id:           id,
+		ThreadId:     threadId,
+		InternalDate: time.Date(2023, 1, 31, 10, minutes, 0, 0, time.UTC).UnixMilli(),
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: from},
+			{Name: "To", Value: to},
+			{Name: "Subject", Value: "subject " + id},
+		}},
+	}
+}
+
+func TestThreadViewAdd(t *testing.T) {
+	tv := newThreadView()
+	for _, msg := range []*gmail.Message{
+		testThreadMessage("m1", "t1", 0, "Jane <Jane@example.com>", "bob@example.com"),
+		testThreadMessage("m2", "t2", 1, "carl@example.com", ""),
+		testThreadMessage("m3", "t1", 2, "bob@example.com", "jane@example.com, Dan <dan@example.com>"),
+	} {
+		tv.add(&ExportedMessage{Message: msg}, nil)
+	}
+	for _, test := range []struct {
+		id           string
+		messages     int
+		participants []string
+	}{
+		{"t1", 2, []string{"jane@example.com", "bob@example.com", "dan@example.com"}},
+		{"t2", 1, []string{"carl@example.com"}},
+	} {
+		thread := tv.byId[test.id]
+		if len(thread.messages) != test.messages || !reflect.DeepEqual(thread.participants, test.participants) {
+			t.Errorf("%s: unexpected messages %d or participants %v", test.id, len(thread.messages), thread.participants)
+		}
+	}
+	if len(tv.threads) != 2 || tv.threads[0].id != "t1" {
+		t.Errorf("expected threads in order of appearance")
+	}
+}
+
+func TestWriteThreads(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject"})
+	msgs := []*gmail.Message{
+		testThreadMessage("m3", "t1", 30, "a@example.com", ""),
+		testThreadMessage("m2", "t2", 20, "b@example.com", ""),
+		testThreadMessage("m1", "t1", 10, "c@example.com", "a@example.com"),
+		testThreadMessage("m4", "t3", 40, "d@example.com", ""),
+	}
+	for _, test := range []struct {
+		maxRows int
+		// thread and subject column of the rows, by sheet
+		want map[string][][]string
+	}{
+		{0, map[string][][]string{ThreadsSheet: {
+			{"t1", "subject m1", "subject m3"},
+			{"t2", "subject m2"},
+			{"t3", "subject m4"},
+		}}},
+		// threads are kept together on a new sheet
+		{5, map[string][][]string{
+			ThreadsSheet:          {{"t1", "subject m1", "subject m3"}},
+			ThreadsSheet + " (2)": {{"t2", "subject m2"}, {"t3", "subject m4"}},
+		}},
+	} {
+		opts := &SpreadsheetOptions{Columns: columns, ThreadView: true, MaxRows: test.maxRows, Location: time.UTC}
+		file := testWorkbooks(t, opts, msgs...)[0]
+		got := make(map[string][][]string)
+		for sheet := range test.want {
+			rows, err := file.GetRows(sheet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows[0][0] != "THREAD ID" || rows[0][len(threadColumns)] != "SUBJECT" {
+				t.Errorf("%s: unexpected header %v", sheet, rows[0])
+			}
+			for rowID, row := range rows[1:] {
+				level, _ := file.GetRowOutlineLevel(sheet, rowID+2)
+				if row[0] != "" {
+					if level != 0 {
+						t.Errorf("%s: unexpected outline level of thread %s", sheet, row[0])
+					}
+					got[sheet] = append(got[sheet], []string{row[0]})
+					continue
+				}
+				if level != 1 {
+					t.Errorf("%s: expected message row %d grouped", sheet, rowID+2)
+				}
+				last := got[sheet][len(got[sheet])-1]
+				got[sheet][len(got[sheet])-1] = append(last, row[len(threadColumns)])
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: expected %v, got %v", test.maxRows, test.want, got)
+		}
+		if header, _ := file.GetRows(ThreadsSheet); !reflect.DeepEqual(header[1][1:3], []string{"2", "a@example.com, c@example.com"}) {
+			t.Errorf("%d: unexpected thread header %v", test.maxRows, header[1])
+		}
+	}
+}
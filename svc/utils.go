@@ -1,6 +1,9 @@
 package svc
 
 import (
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -25,3 +28,38 @@ func RemoveNils[C any | string](s []*C) []*C {
 	ret := s[:i]
 	return ret
 }
+
+// Formats a size in bytes as a human readable string, i.e. 1.5 MB
+func HumanBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Parses a size in bytes, supporting the units of HumanBytes, i.e. 20MB or
+// 500k
+func ParseBytes(input string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(input))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		if exp := strings.IndexByte("KMGTPE", value[n-1]); exp >= 0 {
+			for i := 0; i <= exp; i++ {
+				multiplier *= 1024
+			}
+			value = strings.TrimSpace(value[:n-1])
+		}
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || size < 0 || math.IsNaN(size) || math.IsInf(size, 0) {
+		return 0, fmt.Errorf("invalid size '%s'", input)
+	}
+	return int64(size * float64(multiplier)), nil
+}
@@ -0,0 +1,361 @@
+package svc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Policies applied when a sheet reaches the Excel row limit.
+const (
+	// Continue on a new sheet of the same workbook
+	RolloverSheet = "sheet"
+	// Continue on a new workbook file
+	RolloverFile = "file"
+)
+
+// Saves a completed workbook. Part starts from 1 and increases when rolling
+// over to new workbook files.
+type SaveWorkbook func(file *excelize.File, part int) error
+
+// Physical column of the sheets: a logical column can span several physical
+// ones when split on continuation columns.
+type layoutColumn struct {
+	column  *Column
+	part    int
+	styleID int
+}
+
+// workbook streams messages into one or more sheets, rolling over to new
+// sheets or files when reaching the row limit.
+type workbook struct {
+	opts        *SpreadsheetOptions
+	file        *excelize.File
+	part        int
+	tables      int
+	headerStyle int
+	dateStyle   int
+	layout      []*layoutColumn
+	sheets      []*sheetWriter
+	// whether the default sheet is still available
+	defaultSheet bool
+	// totals of the messages written to the current file
+	total sheetStats
+	seen  map[string]bool
+}
+
+// sheetWriter streams rows into a sheet, named after base and its part.
+type sheetWriter struct {
+	wb *workbook
+	// title as requested, base as made unique
+	title  string
+	base   string
+	part   int
+	name   string
+	stream *excelize.StreamWriter
+	rowID  int
+	stats  sheetStats
+	// titles of sheets not following the layout of messages
+	columns []string
+}
+
+// Returns the header of the column, numbering continuation columns.
+func (col *layoutColumn) title() string {
+	if col.part > 0 {
+		return fmt.Sprintf("%s (%d)", col.column.Title, col.part+1)
+	}
+	return col.column.Title
+}
+
+func newWorkbook(opts *SpreadsheetOptions) (*workbook, error) {
+	wb := &workbook{opts: opts}
+	if err := wb.init(); err != nil {
+		return nil, err
+	}
+	return wb, nil
+}
+
+// Prepares a new workbook file, along with its styles.
+func (wb *workbook) init() error {
+	wb.file = excelize.NewFile()
+	wb.part++
+	wb.tables = 0
+	wb.sheets = nil
+	wb.defaultSheet = true
+	wb.total = sheetStats{}
+	wb.seen = make(map[string]bool)
+	if wb.summary() {
+		wb.file.SetSheetName("Sheet1", SummarySheet)
+		wb.defaultSheet = false
+	}
+	return wb.prepare()
+}
+
+// Prepares the styles and the column layout within the workbook file.
+func (wb *workbook) prepare() error {
+	var err error
+	if wb.headerStyle, err = wb.file.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "#777777"}}); err != nil {
+		return err
+	}
+	if wb.dateStyle, err = wb.file.NewStyle(&excelize.Style{CustomNumFmt: &dateTimeFormat}); err != nil {
+		return err
+	}
+	wb.layout = make([]*layoutColumn, 0, len(wb.opts.Columns))
+	for _, column := range wb.opts.Columns {
+		styleID := 0
+		if column.Style != nil {
+			if styleID, err = wb.file.NewStyle(column.Style); err != nil {
+				return err
+			}
+		}
+		parts := 1
+		if column.Long && wb.opts.CellOverflow == CellOverflowSplit {
+			parts += wb.opts.SplitColumns
+		}
+		for part := 0; part < parts; part++ {
+			wb.layout = append(wb.layout, &layoutColumn{column: column, part: part, styleID: styleID})
+		}
+	}
+	// identifies the rows when appending
+	wb.layout = append(wb.layout, &layoutColumn{column: idColumn})
+	return nil
+}
+
+func (wb *workbook) maxRows() int {
+	if wb.opts.MaxRows > 0 {
+		return wb.opts.MaxRows
+	}
+	return excelize.TotalRows
+}
+
+// Returns a writer for a new sheet of the workbook. Bases clashing with the
+// existing sheets get a numeric suffix.
+func (wb *workbook) newSheet(base string) (*sheetWriter, error) {
+	return wb.newDataSheet(base, nil)
+}
+
+// Returns a writer for a new sheet with the given column titles, rather than
+// the layout of messages.
+func (wb *workbook) newDataSheet(base string, columns []string) (*sheetWriter, error) {
+	unique := base
+	// the default sheet is renamed when still available
+	for n := 2; !wb.defaultSheet && wb.file.GetSheetIndex(sheetName(unique, 1)) >= 0; n++ {
+		unique = fmt.Sprintf("%s %d", base, n)
+	}
+	sw := &sheetWriter{wb: wb, title: base, base: unique, part: 1, columns: columns}
+	if err := sw.open(); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Flushes all the sheets, then saves the workbook.
+func (wb *workbook) save() error {
+	for _, sw := range wb.sheets {
+		if err := sw.flush(); err != nil {
+			return err
+		}
+	}
+	if wb.summary() {
+		if err := wb.writeSummary(); err != nil {
+			return err
+		}
+	}
+	return wb.opts.SaveWorkbook(wb.file, wb.part)
+}
+
+// Saves the current workbook file and continues on a new one, with the same
+// sheets.
+func (wb *workbook) rollover() error {
+	sheets := wb.sheets
+	if err := wb.save(); err != nil {
+		return err
+	}
+	if err := wb.init(); err != nil {
+		return err
+	}
+	for _, sw := range sheets {
+		sw.part = 1
+		sw.stats = sheetStats{}
+		if err := sw.open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var invalidSheetChars = regexp.MustCompile(`[\[\]:*?/\\]`)
+
+// Returns a valid sheet name: at most 31 chars, without reserved ones.
+func sheetName(base string, part int) string {
+	name := strings.Trim(invalidSheetChars.ReplaceAllString(base, "_"), "'")
+	suffix := ""
+	if part > 1 {
+		if base == "Sheet1" {
+			// Sheet1, Sheet2, Sheet3...
+			name = "Sheet"
+			suffix = fmt.Sprint(part)
+		} else {
+			suffix = fmt.Sprintf(" (%d)", part)
+		}
+	}
+	if runes := []rune(name); len(runes)+len(suffix) > 31 {
+		name = string(runes[:31-len(suffix)])
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name + suffix
+}
+
+func (sw *sheetWriter) titles() []string {
+	if sw.columns != nil {
+		return sw.columns
+	}
+	ret := make([]string, 0, len(sw.wb.layout))
+	for _, col := range sw.wb.layout {
+		ret = append(ret, col.title())
+	}
+	return ret
+}
+
+// Creates the sheet for the current part, writing the header row.
+func (sw *sheetWriter) open() error {
+	wb := sw.wb
+	sw.name = sheetName(sw.base, sw.part)
+	if wb.defaultSheet {
+		// reuse the default sheet of new workbooks
+		if sw.name != "Sheet1" {
+			wb.file.SetSheetName("Sheet1", sw.name)
+		}
+		wb.defaultSheet = false
+	} else {
+		wb.file.NewSheet(sw.name)
+	}
+	if sw.part == 1 {
+		wb.sheets = append(wb.sheets, sw)
+	}
+
+	var err error
+	if sw.stream, err = wb.file.NewStreamWriter(sw.name); err != nil {
+		return err
+	}
+	titles := sw.titles()
+	headers := make([]interface{}, 0, len(titles))
+	for _, title := range titles {
+		headers = append(headers, excelize.Cell{StyleID: wb.headerStyle, Value: title})
+	}
+	if err := sw.stream.SetRow("A1", headers,
+		excelize.RowOpts{Height: 25, Hidden: false}); err != nil {
+		return err
+	}
+	sw.rowID = 2
+	// err = file.AutoFilter("Sheet1", "A1", "H1", "")
+	return wb.file.SetPanes(sw.name, `{
+		"freeze": true,
+		"split": false,
+		"x_split": 0,
+		"y_split": 1,
+		"top_left_cell": "B2",
+		"active_pane": "topRight",
+		"panes": [
+		{
+			"sqref": "A2",
+			"active_cell": "A2",
+			"pane": "topRight"
+		}]
+	}`)
+}
+
+// Adds the table decoration and completes the sheet.
+func (sw *sheetWriter) flush() error {
+	wb := sw.wb
+	wb.tables++
+	tableName := "table"
+	if wb.tables > 1 {
+		tableName = fmt.Sprintf("table%d", wb.tables)
+	}
+	lastCell, _ := excelize.CoordinatesToCellName(len(sw.titles()), sw.rowID-1)
+	if err := sw.stream.AddTable("A1", lastCell, fmt.Sprintf(`{
+		"table_name": "%s",
+		"table_style": "TableStyleLight1",
+		"show_first_column": true,
+		"show_last_column": true,
+		"show_row_stripes": true,
+		"show_column_stripes": true
+	}`, tableName)); err != nil {
+		return err
+	}
+	if err := sw.stream.Flush(); err != nil {
+		return err
+	}
+	if sw.columns != nil {
+		return nil
+	}
+	idCol, _ := excelize.ColumnNumberToName(len(wb.layout))
+	return wb.file.SetColVisible(sw.name, idCol, false)
+}
+
+// Returns the cells of the row for a message, following the layout.
+func (wb *workbook) row(msg *ExportedMessage) ([]interface{}, error) {
+	row := make([]interface{}, 0, len(wb.layout))
+	for i := 0; i < len(wb.layout); {
+		col := wb.layout[i]
+		parts := 1
+		for i+parts < len(wb.layout) && wb.layout[i+parts].column == col.column {
+			parts++
+		}
+		cells, err := overflowCells(col.column, col.column.Value(msg, wb.opts), parts, msg, wb.opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range cells {
+			if cell, ok := value.(excelize.Cell); ok {
+				cell.StyleID = col.styleID
+				value = cell
+			} else if col.styleID != 0 && value != nil {
+				value = excelize.Cell{StyleID: col.styleID, Value: value}
+			}
+			row = append(row, value)
+		}
+		i += parts
+	}
+	return row, nil
+}
+
+// Writes a row, rolling over when the row limit has been reached.
+func (sw *sheetWriter) writeRow(row []interface{}, opts ...excelize.RowOpts) error {
+	if sw.rowID > sw.wb.maxRows() {
+		if sw.wb.opts.Rollover == RolloverFile {
+			if err := sw.wb.rollover(); err != nil {
+				return err
+			}
+		} else {
+			if err := sw.flush(); err != nil {
+				return err
+			}
+			sw.part++
+			if err := sw.open(); err != nil {
+				return err
+			}
+		}
+	}
+	cell, _ := excelize.CoordinatesToCellName(1, sw.rowID)
+	sw.rowID++
+	return sw.stream.SetRow(cell, row, opts...)
+}
+
+// Writes the row of a message, accounting it on the sheet totals.
+func (sw *sheetWriter) writeMessage(msg *ExportedMessage, row []interface{}) error {
+	if err := sw.writeRow(row); err != nil {
+		return err
+	}
+	sw.stats.add(msg)
+	if !sw.wb.seen[msg.Id] {
+		sw.wb.seen[msg.Id] = true
+		sw.wb.total.add(msg)
+	}
+	return nil
+}
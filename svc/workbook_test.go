@@ -0,0 +1,89 @@
+package svc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Returns messages having just an id and a subject.
+func testSubjectMessages(ids ...string) []*gmail.Message {
+	ret := make([]*gmail.Message, 0, len(ids))
+	for msg := range testMessages(nil, ids...) {
+		ret = append(ret, msg)
+	}
+	return ret
+}
+
+func TestSheetName(t *testing.T) {
+	for _, test := range []struct {
+		base string
+		part int
+		want string
+	}{
+		{"Sheet1", 1, "Sheet1"},
+		{"Sheet1", 3, "Sheet3"},
+		{"Work", 1, "Work"},
+		{"Work", 2, "Work (2)"},
+		{"a/b:c*d?[e]\\f", 1, "a_b_c_d__e__f"},
+		{"'quoted'", 1, "quoted"},
+		{"''", 1, "_"},
+		{strings.Repeat("x", 40), 1, strings.Repeat("x", 31)},
+		{strings.Repeat("è", 40), 12, strings.Repeat("è", 26) + " (12)"},
+	} {
+		if got := sheetName(test.base, test.part); got != test.want {
+			t.Errorf("%q %d: expected %q, got %q", test.base, test.part, test.want, got)
+		}
+	}
+}
+
+func TestRollover(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject"})
+	for _, test := range []struct {
+		rollover string
+		maxRows  int
+		// ids by sheet, by workbook file
+		want []map[string][]string
+	}{
+		{"", 0, []map[string][]string{
+			{"Sheet1": {"m1", "m2", "m3", "m4", "m5"}},
+		}},
+		{RolloverSheet, 3, []map[string][]string{
+			{"Sheet1": {"m1", "m2"}, "Sheet2": {"m3", "m4"}, "Sheet3": {"m5"}},
+		}},
+		{RolloverFile, 3, []map[string][]string{
+			{"Sheet1": {"m1", "m2"}},
+			{"Sheet1": {"m3", "m4"}},
+			{"Sheet1": {"m5"}},
+		}},
+		{RolloverFile, 6, []map[string][]string{
+			{"Sheet1": {"m1", "m2", "m3", "m4", "m5"}},
+		}},
+	} {
+		opts := &SpreadsheetOptions{Columns: columns, MaxRows: test.maxRows, Rollover: test.rollover}
+		files := testWorkbooks(t, opts, testSubjectMessages("m1", "m2", "m3", "m4", "m5")...)
+		got := make([]map[string][]string, 0)
+		for _, file := range files {
+			got = append(got, sheetIds(t, file))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %d: expected %v, got %v", test.rollover, test.maxRows, test.want, got)
+		}
+	}
+}
+
+func TestSplitLayout(t *testing.T) {
+	columns, _ := ParseColumns([]string{"subject", "text_body"})
+	opts := &SpreadsheetOptions{Columns: columns, CellOverflow: CellOverflowSplit, SplitColumns: 2}
+	file := testWorkbooks(t, opts, testSubjectMessages("m1")...)[0]
+	rows, err := file.GetRows("Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SUBJECT", "TEXT BODY", "TEXT BODY (2)", "TEXT BODY (3)", IdColumnTitle}
+	if !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("expected %v, got %v", want, rows[0])
+	}
+}
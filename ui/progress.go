@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/vbauerster/mpb/v7"
 	"github.com/vbauerster/mpb/v7/decor"
@@ -13,6 +14,8 @@ type ProgressUI struct {
 
 	bar         *mpb.Bar
 	progressBar *mpb.Bar
+	total       int64
+	mutex       sync.Mutex
 }
 
 func (pui *ProgressUI) Init(width int) {
@@ -59,7 +62,11 @@ func (pui *ProgressUI) SpreadsheetTotal(total int64) {
 	}
 	taskName := "ETA"
 
-	pui.progressBar = pui.BarContainer.New(total,
+	pui.mutex.Lock()
+	defer pui.mutex.Unlock()
+	// messages may have been added in the meantime
+	pui.total += total
+	pui.progressBar = pui.BarContainer.New(pui.total,
 		// BarFillerBuilder with custom style
 		mpb.BarStyle(),
 		mpb.PrependDecorators(
@@ -81,3 +88,17 @@ func (pui *ProgressUI) SpreadsheetIncrement() {
 	}
 	pui.progressBar.Increment()
 }
+
+// Adds to the messages to be exported, i.e. when pulling in whole threads.
+// Negative values account for messages skipped after all.
+func (pui *ProgressUI) SpreadsheetAddTotal(count int64) {
+	if pui.Hide {
+		return
+	}
+	pui.mutex.Lock()
+	defer pui.mutex.Unlock()
+	pui.total += count
+	if pui.progressBar != nil {
+		pui.progressBar.SetTotal(pui.total, false)
+	}
+}